@@ -0,0 +1,17 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// posixFadvDontneed is POSIX_FADV_DONTNEED from <fcntl.h>
+const posixFadvDontneed = 4
+
+// dropCache asks the kernel to discard the cached pages of f, so the next read comes from
+// the device. It is best effort: dirty pages stay cached until they have been written.
+func dropCache(f *os.File) {
+	syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, posixFadvDontneed, 0, 0)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "os"
+
+// fileID is not implemented on this platform
+func fileID(info os.FileInfo) (inode, uint64, bool) {
+	return inode{}, 0, false
+}
@@ -1,32 +1,193 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 // Version of the utility
 const Version = "1.4.0"
 
+// Exit codes reported to scripts. Code 2 is used by the flag package for invalid options.
+const (
+	ExitFatal        = 1 // The run was aborted by an error
+	ExitDiskFull     = 3 // The destination ran out of space; the remaining files were not copied
+	ExitInconsistent = 4 // Some source files kept changing while being copied
+	ExitErrors       = 5 // Some files failed to copy and were skipped (--keep-going)
+	ExitDamaged      = 6 // Some source files had unreadable regions that were zero-filled (--salvage)
+	ExitDifferent    = 7 // The verify command found differences between source and destination
+	ExitCorrupt      = 8 // The scrub command found files that no longer match the manifest
+	ExitProbeFailed  = 9 // The probe command found test data that did not read back correctly
+)
+
+// opError records which operation failed on which path, so failures can be collected by --keep-going
+type opError struct {
+	op   string
+	path string
+	err  error
+}
+
+func (e *opError) Error() string { return e.err.Error() }
+func (e *opError) Unwrap() error { return e.err }
+
+// opFailed wraps err with the operation and path it concerns
+func opFailed(op, path string, err error) error {
+	return &opError{op: op, path: path, err: err}
+}
+
+// exitError is an error that terminates the program with a specific exit code
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
 // CopyStats tracks statistics during the copy operation
 type CopyStats struct {
-	FilesCopied  int
-	FilesSkipped int
-	BytesCopied  int64
-	ExtraFound   int
-	ExtraDeleted int
-	ExtraBytes   int64
-	StartTime    time.Time
+	FilesCopied     int
+	FilesSkipped    int
+	BytesCopied     int64
+	ExtraFound      int
+	ExtraDeleted    int
+	ExtraBytes      int64
+	Collisions      int
+	MetaSkipped     int
+	MetaMerged      int
+	Inconsistent    []string      // Source files that kept changing while being copied
+	Failures        []CopyFailure // Errors that were skipped with --keep-going
+	Retries         int           // Operations repeated after a transient I/O error
+	Damaged         []DamagedFile // Files copied with unreadable regions zero-filled (--salvage)
+	Trashed         int           // Extras moved to the trash instead of being deleted (--trash)
+	FilesLinked     int           // Unchanged files hard-linked to the previous snapshot (--snapshot)
+	DirsPruned      int           // Empty destination directories removed (--prune-empty-dirs)
+	ExtraCopiedBack int           // Extras copied from the destination back into the source
+	BackedUp        int           // Replaced files and extras moved to the backup directory (--backup-dir)
+	BytesVerified   int64         // Bytes read back from the destination and found identical (--verify)
+	StartTime       time.Time
+}
+
+// CopyFailure records an error that was skipped with --keep-going
+type CopyFailure struct {
+	Path string
+	Op   string
+	Err  error
+}
+
+// BadRange is a region of a source file that could not be read
+type BadRange struct {
+	Offset int64
+	Length int64
+}
+
+// DamagedFile records the unreadable regions of a file copied in salvage mode
+type DamagedFile struct {
+	Path string
+	Bad  []BadRange
 }
 
 // SyncOptions holds the synchronization configuration
 type SyncOptions struct {
 	DetectExtra bool
 	DeleteExtra bool
+	Review      bool   // Ask what to do with each extra instead of deleting all of them
+	Adopt       bool   // Copy extras back into the source instead of deleting them
+	DeleteWhen  string // When -D deletes extras: "before", "during" or "after" copying
+}
+
+// CopyOptions holds the configuration used while copying files
+type CopyOptions struct {
+	Normalize     string        // Unicode normalization form for destination names: "nfc", "nfd" or "none"
+	MacMetadata   string        // Policy for macOS metadata files: "copy", "skip", "protect" or "merge"
+	ChangeRetries int           // How many times to recopy a source file that changed while being copied
+	Exclude       []os.FileInfo // Source directories that are skipped because they hold the destination
+	KeepGoing     bool          // Record failures and continue with the next file instead of aborting
+	Retries       int           // How many times to repeat an operation that failed with a transient I/O error
+	RetryDelay    time.Duration // Wait before the first retry; doubled for every further retry
+	StallTimeout  time.Duration // Give up on a file when no data moved for this long (0 disables the watchdog)
+	Salvage       bool          // Read failing media block by block and zero-fill unreadable regions
+	Verify        bool          // Read every copy back from the device and compare it with the source hash
+	Manifest      *Manifest     // Hashes of the copied files, written to the destination root (nil when disabled)
+	BackupDir     string        // Where replaced and deleted destination files are moved to ("" removes them)
+	BackupRoot    string        // Directory holding the backup directories of every run (BackupDir without date placeholders)
+	Journal       *Journal      // Records every change to the destination so the run can be undone (nil when disabled)
+	Trash         bool          // Move extras deleted by -D to the freedesktop.org trash
+	DestRoot      string        // Destination root; paths in the backup directory are relative to it
+	Protect       []string      // Patterns for destination paths that are never treated as extras
+	DeleteDuring  string        // Mirrored directory whose extras are deleted while it is copied ("" when off)
+	SnapshotDir   string        // Snapshot being written (--snapshot)
+	LinkDest      string        // Previous snapshot; files unchanged since then are hard-linked from it
+}
+
+// patternList collects the values of a flag that may be given several times
+type patternList []string
+
+func (p *patternList) String() string { return strings.Join(*p, ",") }
+
+func (p *patternList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// errStalled is returned when the watchdog sees no progress on a file operation
+var errStalled = errors.New("operation stalled")
+
+// errVerifyMismatch is returned when a copy read back from the destination differs from the source
+var errVerifyMismatch = errors.New("verification failed")
+
+// errCopyBackConflict is returned when an extra cannot be copied back without clobbering the source
+var errCopyBackConflict = errors.New("not copied back")
+
+// verifyRecopies is how many times a file is copied again after its verification failed
+const verifyRecopies = 2
+
+// errXattrUnsupported is returned when the destination cannot store extended attributes
+var errXattrUnsupported = errors.New("extended attributes not supported")
+
+// macMetadataNames lists files and directories that macOS creates on foreign volumes
+var macMetadataNames = map[string]bool{
+	".DS_Store":               true,
+	".Spotlight-V100":         true,
+	".Trashes":                true,
+	".fseventsd":              true,
+	".TemporaryItems":         true,
+	".DocumentRevisions-V100": true,
+	".apdisk":                 true,
+}
+
+// normalizeName applies the configured Unicode normalization form to a file name or relative path.
+// macOS tools tend to produce NFD names while Linux tools produce NFC, so the same logical
+// name can otherwise appear twice in the destination.
+func normalizeName(name string, opts *CopyOptions) string {
+	switch opts.Normalize {
+	case "nfc":
+		return norm.NFC.String(name)
+	case "nfd":
+		return norm.NFD.String(name)
+	default:
+		return name
+	}
 }
 
 // sanitizeFATTime clamps timestamps to the valid FAT/exFAT range to avoid invalid-date failures.
@@ -46,22 +207,84 @@ func sanitizeFATTime(t time.Time) time.Time {
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
+		os.Exit(ExitFatal)
 	}
 }
 
 func run() error {
+	// Commands are given as the first argument; anything else is a copy
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			return runVerify(os.Args[2:])
+		case "scrub":
+			return runScrub(os.Args[2:])
+		case "probe":
+			return runProbe(os.Args[2:])
+		case "undo":
+			return runUndo(os.Args[2:])
+		case "prune":
+			return runPrune(os.Args[2:])
+		case "versions":
+			return runVersions(os.Args[2:])
+		case "restore":
+			return runRestore(os.Args[2:])
+		}
+	}
+
 	var detectExtra = flag.Bool("d", false, "detect extra files in destination not present in source")
 	var deleteExtra = flag.Bool("D", false, "detect and delete extra files in destination not present in source")
+	var adopt = flag.Bool("adopt", false, "copy extra files in destination back into the source, never replacing anything there")
+	var deleteBefore = flag.Bool("delete-before", false, "with -D, delete extras before copying, so their space is free for new files")
+	var deleteDuring = flag.Bool("delete-during", false, "with -D, delete the extras of each directory before copying its contents")
+	var deleteAfter = flag.Bool("delete-after", false, "with -D, delete extras after copying (the default)")
+	var pruneEmptyDirs = flag.Bool("prune-empty-dirs", false, "remove directories that are empty in the destination after copying")
+	var protect patternList
+	flag.Var(&protect, "protect", "never report or delete destination paths matching this pattern (may be repeated)")
+	var protectFrom = flag.String("protect-from", "", "read --protect patterns from a file, one per line")
+	var review = flag.Bool("review", false, "review extra files one by one (delete, keep or copy back to the source) before anything is deleted")
+	var normalize = flag.String("normalize", "none", "Unicode normalization for destination names: nfc, nfd or none")
+	var keepGoing = flag.Bool("keep-going", false, "record errors and continue with the remaining files instead of stopping")
+	var retries = flag.Int("retries", 0, "times to retry file operations that fail with a transient I/O error (EIO, EAGAIN, ETIMEDOUT)")
+	var retryDelay = flag.Duration("retry-delay", time.Second, "wait before the first retry, doubled for every further retry")
+	var stallTimeout = flag.Duration("stall-timeout", 0, "give up on a file when no data moved for this long, e.g. 30s (0 disables)")
+	var salvage = flag.Bool("salvage", false, "rescue mode for failing media: skip unreadable blocks and zero-fill them in the copy")
+	var backupDir = flag.String("backup-dir", "", "move replaced files and extras deleted by -D here instead of removing them; %Y %m %d %H %M %S expand to the date and time")
+	var snapshot = flag.Bool("snapshot", false, "write each run to a new dated directory in the destination, hard-linking files unchanged since the previous one")
+	var retention = retentionFlags(flag.CommandLine)
+	var journal = flag.Bool("journal", false, "record every change to the destination so the run can be reverted with 'smartcopy undo'")
+	var trash = flag.Bool("trash", false, "move extras deleted by -D to the desktop trash instead of removing them")
+	var manifest = flag.Bool("manifest", false, "write a SHA-256 manifest of all copied files to the destination root ("+manifestName+")")
+	var verify = flag.Bool("verify", false, "read every copied file back from the destination and compare it with the source")
+	var changeRetries = flag.Int("change-retries", 3, "times to recopy a source file that changes while being copied")
+	var noSpaceCheck = flag.Bool("no-space-check", false, "copy even if the destination does not appear to have enough free space")
+	var macMetadata = flag.String("mac-metadata", "copy", "policy for macOS metadata files (._*, .DS_Store, ...): copy, skip, protect or merge")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <source1> [source2...] <destination>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s verify [options] <source1> [source2...] <destination>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s scrub [--source=DIR] <destination>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s probe [--limit=MiB] <destination>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s undo <destination>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s prune [--dry-run] --keep-...=N <destination>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s versions <destination> <path>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s restore [--snapshot=NAME | --at=TIME] <destination> <path> <target>\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  %s source dest              # Basic copy\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -d source dest           # Copy and detect extra files\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -D source dest           # Copy and delete extra files\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --normalize=nfc src dest # Store destination names in NFC form\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --mac-metadata=skip -D src dest # Mirror without macOS metadata files\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s verify --checksum src dest # Compare a backup with its source\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s scrub --source=src dest    # Check a backup for bit rot and repair it\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s probe /media/usb           # Test the real capacity of a drive\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --journal -D src dest      # Mirror, keeping what is needed to undo the run\n", os.Args[0])
 	}
 
 	flag.Parse()
@@ -74,8 +297,77 @@ func run() error {
 	}
 
 	syncOptions := &SyncOptions{
-		DetectExtra: *detectExtra || *deleteExtra, // -D implies -d
+		DetectExtra: *detectExtra || *deleteExtra || *review || *adopt, // -D, --review and --adopt imply -d
 		DeleteExtra: *deleteExtra,
+		Review:      *review,
+		Adopt:       *adopt,
+		DeleteWhen:  "after",
+	}
+	if *deleteBefore {
+		syncOptions.DeleteWhen = "before"
+	}
+	if *deleteDuring {
+		syncOptions.DeleteWhen = "during"
+	}
+	deleteChoices := 0
+	for _, set := range []bool{*deleteBefore, *deleteDuring, *deleteAfter} {
+		if set {
+			deleteChoices++
+		}
+	}
+	if deleteChoices > 1 {
+		return fmt.Errorf("only one of --delete-before, --delete-during and --delete-after can be used")
+	}
+	if (*deleteBefore || *deleteDuring || *deleteAfter) && !*deleteExtra {
+		return fmt.Errorf("--delete-before, --delete-during and --delete-after need -D")
+	}
+	if (*deleteBefore || *deleteDuring) && *review {
+		return fmt.Errorf("--review asks about the extras after copying and cannot be combined with --delete-before or --delete-during")
+	}
+
+	if err := checkNameOptions(*normalize, *macMetadata); err != nil {
+		return err
+	}
+	if *changeRetries < 0 {
+		return fmt.Errorf("invalid --change-retries value %d (must be 0 or more)", *changeRetries)
+	}
+	if *retries < 0 {
+		return fmt.Errorf("invalid --retries value %d (must be 0 or more)", *retries)
+	}
+	if *snapshot && (syncOptions.DetectExtra || *journal || *trash || *backupDir != "") {
+		return fmt.Errorf("--snapshot writes a new directory every run and cannot be combined with -d, -D, --review, --adopt, --journal, --trash or --backup-dir")
+	}
+	if err := retention.check(); err != nil {
+		return err
+	}
+	if !retention.empty() && !*snapshot {
+		return fmt.Errorf("the --keep-* options remove old snapshots and need --snapshot")
+	}
+	if *adopt && (*deleteExtra || *review) {
+		return fmt.Errorf("--adopt keeps all extras and cannot be combined with -D or --review")
+	}
+	if *trash && *backupDir != "" {
+		return fmt.Errorf("--trash and --backup-dir cannot be used together")
+	}
+	if *journal && (*trash || *backupDir != "") {
+		return fmt.Errorf("--journal keeps the originals itself and cannot be combined with --trash or --backup-dir")
+	}
+	protectPatterns, err := loadProtectPatterns(protect, *protectFrom)
+	if err != nil {
+		return err
+	}
+	copyOptions := &CopyOptions{
+		Protect:       protectPatterns,
+		Normalize:     *normalize,
+		MacMetadata:   *macMetadata,
+		ChangeRetries: *changeRetries,
+		KeepGoing:     *keepGoing,
+		Retries:       *retries,
+		RetryDelay:    *retryDelay,
+		StallTimeout:  *stallTimeout,
+		Salvage:       *salvage,
+		Verify:        *verify,
+		Trash:         *trash,
 	}
 
 	// Last argument is destination, everything else is sources
@@ -91,6 +383,18 @@ func run() error {
 		}
 	}
 
+	// A snapshot run copies into a new directory inside the destination
+	var snap *Snapshot
+	if *snapshot {
+		var err error
+		if snap, err = startSnapshot(destination, time.Now()); err != nil {
+			return err
+		}
+		destination = snap.Dir
+		copyOptions.SnapshotDir = snap.Dir
+		copyOptions.LinkDest = snap.Previous
+	}
+
 	// Check if destination exists and is a directory
 	destInfo, destErr := os.Stat(destination)
 	isDestDir := destErr == nil && destInfo.IsDir()
@@ -105,359 +409,4020 @@ func run() error {
 		StartTime: time.Now(),
 	}
 
-	// Copy each source
-	for _, source := range sources {
-		var targetPath string
-
-		if len(sources) == 1 {
-			// Single source: use standard cp behavior
-			if isDestDir {
-				// Destination exists and is directory: put source inside it
-				srcName := filepath.Base(source)
-				targetPath = filepath.Join(destination, srcName)
-			} else {
-				// Destination doesn't exist or is file: use as-is
-				targetPath = destination
-			}
-		} else {
-			// Multiple sources: always put inside destination directory
-			if destErr != nil {
-				// Destination doesn't exist, create it as directory
-				if err := os.MkdirAll(destination, 0755); err != nil {
-					return fmt.Errorf("failed to create destination directory '%s': %w", destination, err)
-				}
-			}
-			srcName := filepath.Base(source)
-			targetPath = filepath.Join(destination, srcName)
+	// Sources are placed inside the destination when it is an existing directory or when there are several
+	intoDest := len(sources) > 1 || isDestDir
+
+	// Refuse to copy onto the source itself, and keep a destination inside a source out of the copy
+	if err := checkOverlap(sources, destination, intoDest, copyOptions); err != nil {
+		return err
+	}
+
+	// The destination root holds the manifest and is what backup paths are relative to.
+	// It is the destination directory, or the directory of a destination file.
+	copyOptions.DestRoot = destination
+	if !intoDest {
+		if info, err := os.Stat(sources[0]); err == nil && !info.IsDir() {
+			copyOptions.DestRoot = filepath.Dir(destination)
+		}
+	}
+
+	// Extras are moved to the trash only after copying, so make sure there is one first
+	if copyOptions.Trash && (syncOptions.DeleteExtra || syncOptions.Review) {
+		if err := checkTrash(copyOptions.DestRoot); err != nil {
+			return fmt.Errorf("--trash cannot be used for '%s': %w", copyOptions.DestRoot, err)
+		}
+	}
+
+	// A relative backup directory is placed in the destination root, like rsync does
+	// The backup directories of earlier runs are kept under the fixed part of the pattern
+	if *backupDir != "" {
+		dir := expandDatePlaceholders(*backupDir, stats.StartTime)
+		root := backupRoot(*backupDir)
+		if root == "." {
+			root = dir
+		}
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(copyOptions.DestRoot, dir)
+		}
+		if !filepath.IsAbs(root) {
+			root = filepath.Join(copyOptions.DestRoot, root)
 		}
+		copyOptions.BackupDir = dir
+		copyOptions.BackupRoot = root
+		fmt.Printf("Backup directory: %s\n", dir)
+	}
 
-		if err := copyRecursively(source, targetPath, stats); err != nil {
+	// Load the manifest of earlier runs, so up to date files do not need to be hashed again
+	// In a snapshot, the hashes come from the manifest of the previous snapshot
+	if *manifest {
+		manifestFrom := copyOptions.DestRoot
+		if copyOptions.LinkDest != "" {
+			manifestFrom = copyOptions.LinkDest
+		}
+		var targets []string
+		for _, source := range sources {
+			targets = append(targets, targetPathFor(source, destination, intoDest, copyOptions))
+		}
+		m, err := loadManifest(copyOptions.DestRoot, manifestFrom, targets)
+		if err != nil {
 			return err
 		}
+		copyOptions.Manifest = m
 	}
 
-	// Handle extra file detection/deletion for single source scenarios
-	if len(sources) == 1 && syncOptions.DetectExtra {
-		source := sources[0]
-		var finalDestination string
+	// Make sure the destination can hold everything before writing anything
+	if !*noSpaceCheck {
+		if err := checkFreeSpace(sources, destination, intoDest, syncOptions, copyOptions); err != nil {
+			return err
+		}
+	}
 
-		if isDestDir {
-			// Source was copied into the destination directory
-			srcName := filepath.Base(source)
-			finalDestination = filepath.Join(destination, srcName)
-		} else {
-			// Source was copied as the destination
-			finalDestination = destination
+	if *journal {
+		j, err := startJournal(copyOptions.DestRoot, stats.StartTime)
+		if err != nil {
+			return err
 		}
+		defer j.close()
+		copyOptions.Journal = j
+	}
+
+	// A run that stops early still writes the manifest, with the files it has hashed so far
+	if copyOptions.Manifest != nil {
+		defer func() {
+			if !copyOptions.Manifest.saved {
+				if err := copyOptions.Manifest.save(copyOptions.Journal, false); err != nil {
+					fmt.Printf("WARNING: %v\n", err)
+				}
+			}
+		}()
+	}
 
-		if err := handleExtraFiles(source, finalDestination, syncOptions, stats); err != nil {
+	// With --delete-before, extras are removed first so their space is free for the copy,
+	// and with --delete-during each directory is cleaned up just before it is copied
+	if len(sources) == 1 && syncOptions.DeleteWhen == "before" {
+		if err := handleExtraFiles(sources[0], targetPathFor(sources[0], destination, intoDest, copyOptions), syncOptions, copyOptions, stats); err != nil {
 			return err
 		}
 	}
+	if len(sources) == 1 && syncOptions.DeleteWhen == "during" {
+		copyOptions.DeleteDuring = targetPathFor(sources[0], destination, intoDest, copyOptions)
+	}
 
-	// Display summary statistics
-	showSummary(stats, syncOptions)
-	return nil
-}
+	// Copy each source
+	for _, source := range sources {
+		if len(sources) > 1 && destErr != nil {
+			// Destination doesn't exist, create it as directory
+			if err := os.MkdirAll(destination, 0755); err != nil {
+				return fmt.Errorf("failed to create destination directory '%s': %w", destination, err)
+			}
+		}
 
-// copyRecursively copies files and directories from src to dst recursively
-func copyRecursively(src, dst string, stats *CopyStats) error {
-	srcInfo, err := os.Stat(src)
-	if err != nil {
-		return fmt.Errorf("failed to get source info: %w", err)
+		err := copyRecursively(source, targetPathFor(source, destination, intoDest, copyOptions), copyOptions, stats)
+		if err = recordFailure(source, err, copyOptions, stats); err != nil {
+			if isDiskFull(err) {
+				return reportDiskFull(err, sources, destination, intoDest, syncOptions, copyOptions, stats)
+			}
+			return err
+		}
 	}
 
-	if srcInfo.IsDir() {
-		return copyDirectory(src, dst, srcInfo, stats)
+	// Handle extra file detection/deletion for single source scenarios
+	if len(sources) == 1 && syncOptions.DetectExtra && syncOptions.DeleteWhen == "after" {
+		source := sources[0]
+		finalDestination := targetPathFor(source, destination, intoDest, copyOptions)
+
+		if err := handleExtraFiles(source, finalDestination, syncOptions, copyOptions, stats); err != nil {
+			return err
+		}
 	}
-	return copyFile(src, dst, srcInfo, stats)
-}
 
-// copyDirectory creates the destination directory and copies all contents
-func copyDirectory(src, dst string, srcInfo os.FileInfo, stats *CopyStats) error {
-	// Create destination directory with same permissions
-	if err := os.MkdirAll(dst, srcInfo.Mode()); err != nil {
-		return fmt.Errorf("failed to create directory '%s': %w", dst, err)
+	// Items removed from the sources since an interrupted snapshot are not part of this one
+	if snap != nil && len(stats.Failures) == 0 {
+		snap.removeStale(sources, intoDest, copyOptions, stats)
 	}
 
-	// Read directory entries
-	entries, err := os.ReadDir(src)
-	if err != nil {
-		return fmt.Errorf("failed to read directory '%s': %w", src, err)
+	if *pruneEmptyDirs {
+		for _, source := range sources {
+			if info, err := os.Stat(source); err == nil && info.IsDir() {
+				pruneEmptyDirectories(source, targetPathFor(source, destination, intoDest, copyOptions), copyOptions, stats)
+			}
+		}
 	}
 
-	// Copy each entry recursively
-	for _, entry := range entries {
-		srcPath := filepath.Join(src, entry.Name())
-		dstPath := filepath.Join(dst, entry.Name())
+	if copyOptions.Manifest != nil {
+		if err := copyOptions.Manifest.save(copyOptions.Journal, len(stats.Failures) == 0); err != nil {
+			return err
+		}
+	}
 
-		if err := copyRecursively(srcPath, dstPath, stats); err != nil {
+	// A snapshot with errors is left incomplete, so latest keeps pointing to a complete one
+	if snap != nil {
+		if len(stats.Failures) > 0 {
+			fmt.Printf("\nSnapshot left incomplete in %s; the next run resumes it\n", snap.Dir)
+		} else if err := snap.finish(); err != nil {
 			return err
+		} else if !retention.empty() {
+			fmt.Printf("\nApplying the retention policy to %s\n", snap.Root)
+			if err := pruneSnapshots(snap.Root, *retention, false); err != nil {
+				return err
+			}
 		}
 	}
 
-	// After all contents are copied, set directory times to a sanitized source time
-	m := sanitizeFATTime(srcInfo.ModTime())
-	if err := os.Chtimes(dst, m, m); err != nil {
-		return fmt.Errorf("failed to set directory times for '%s': %w", dst, err)
+	// Display summary statistics
+	showSummary(stats, syncOptions)
+	if snap != nil && len(stats.Failures) == 0 {
+		fmt.Printf("Snapshot: %s\n", filepath.Join(snap.Root, snap.Name))
+	}
+	if copyOptions.Journal != nil {
+		fmt.Printf("Journal: %s (revert this run with: smartcopy undo %s)\n", copyOptions.Journal.Dir, copyOptions.DestRoot)
 	}
 
+	if len(stats.Failures) > 0 {
+		return &exitError{
+			code: ExitErrors,
+			err:  fmt.Errorf("%d errors occurred, the affected files were not copied", len(stats.Failures)),
+		}
+	}
+	if len(stats.Damaged) > 0 {
+		return &exitError{
+			code: ExitDamaged,
+			err:  fmt.Errorf("%d files had unreadable regions that were zero-filled", len(stats.Damaged)),
+		}
+	}
+	if len(stats.Inconsistent) > 0 {
+		return &exitError{
+			code: ExitInconsistent,
+			err:  fmt.Errorf("%d files changed while being copied and may be inconsistent", len(stats.Inconsistent)),
+		}
+	}
 	return nil
 }
 
-// formatBytes formats bytes with appropriate prefixes
-func formatBytes(bytes int64) string {
-	if bytes >= 1e9 {
-		return fmt.Sprintf("%.1fGB", float64(bytes)/1e9)
-	} else if bytes >= 1e6 {
-		return fmt.Sprintf("%.0fMB", float64(bytes)/1e6)
-	} else if bytes >= 1e3 {
-		return fmt.Sprintf("%.0fkB", float64(bytes)/1e3)
-	} else {
-		return fmt.Sprintf("%dB", bytes)
+// checkNameOptions validates the --normalize and --mac-metadata values
+func checkNameOptions(normalize, macMetadata string) error {
+	switch normalize {
+	case "nfc", "nfd", "none":
+	default:
+		return fmt.Errorf("invalid --normalize value '%s' (expected nfc, nfd or none)", normalize)
+	}
+	switch macMetadata {
+	case "copy", "skip", "protect", "merge":
+	default:
+		return fmt.Errorf("invalid --mac-metadata value '%s' (expected copy, skip, protect or merge)", macMetadata)
 	}
+	return nil
 }
 
-// formatSpeed formats bytes per second with appropriate prefixes
-func formatSpeed(bytesPerSec float64) string {
-	if bytesPerSec >= 1e9 {
-		return fmt.Sprintf("%.1fGB/s", bytesPerSec/1e9)
-	} else if bytesPerSec >= 1e6 {
-		return fmt.Sprintf("%.0fMB/s", bytesPerSec/1e6)
-	} else if bytesPerSec >= 1e3 {
-		return fmt.Sprintf("%.0fkB/s", bytesPerSec/1e3)
-	} else {
-		return fmt.Sprintf("%.0fB/s", bytesPerSec)
-	}
+// VerifyReport collects the differences found by the verify command
+type VerifyReport struct {
+	Checked int      // Source files compared with their copy
+	Missing []string // Source entries that have no copy in the destination
+	Extra   []string // Destination entries that are not in the source
+	Size    []string // Files whose copy has a different size
+	Time    []string // Files whose copy has a different modification time
+	Content []string // Files whose copy has different contents (--checksum)
 }
 
-// handleExtraFiles handles detection and optional deletion of extra files in destination
-func handleExtraFiles(src, dst string, syncOptions *SyncOptions, stats *CopyStats) error {
-	// Build a map of all files/directories that should exist in destination
-	sourceItems := make(map[string]bool)
+// runVerify implements the verify command: it compares the destination with the sources the way
+// a copy would, without changing anything, and exits with ExitDifferent when they do not match
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	var checksum = flags.Bool("checksum", false, "also compare file contents by SHA-256 hash (reads every file)")
+	var normalize = flags.String("normalize", "none", "Unicode normalization used for destination names: nfc, nfd or none")
+	var macMetadata = flags.String("mac-metadata", "copy", "policy used for macOS metadata files: copy, skip, protect or merge")
+	var protect patternList
+	flags.Var(&protect, "protect", "never report destination paths matching this pattern as extra (may be repeated)")
+	var protectFrom = flags.String("protect-from", "", "read --protect patterns from a file, one per line")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify [options] <source1> [source2...] <destination>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nCompares the destination with the sources without copying anything.\n")
+		fmt.Fprintf(os.Stderr, "Use the same sources, destination and name options as for the copy.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = flags.Args()
 
-	srcInfo, err := os.Stat(src)
+	if len(args) < 2 {
+		flags.Usage()
+		return fmt.Errorf("insufficient arguments")
+	}
+	if err := checkNameOptions(*normalize, *macMetadata); err != nil {
+		return err
+	}
+	protectPatterns, err := loadProtectPatterns(protect, *protectFrom)
 	if err != nil {
-		return fmt.Errorf("failed to stat source '%s': %w", src, err)
+		return err
 	}
+	opts := &CopyOptions{Normalize: *normalize, MacMetadata: *macMetadata, Protect: protectPatterns}
 
-	if srcInfo.IsDir() {
-		err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
+	sources := args[:len(args)-1]
+	destination := args[len(args)-1]
+	for _, source := range sources {
+		if _, err := os.Stat(source); err != nil {
+			return fmt.Errorf("failed to get source info for '%s': %w", source, err)
+		}
+	}
+	destInfo, err := os.Stat(destination)
+	if err != nil {
+		return fmt.Errorf("failed to get destination info for '%s': %w", destination, err)
+	}
+	intoDest := len(sources) > 1 || destInfo.IsDir()
 
-			// Get relative path from source root
-			relPath, err := filepath.Rel(src, path)
-			if err != nil {
-				return err
-			}
+	report := &VerifyReport{}
+	for _, source := range sources {
+		if err := verifyTree(source, targetPathFor(source, destination, intoDest, opts), *checksum, opts, report); err != nil {
+			return err
+		}
+	}
 
-			// Skip the root directory itself
-			if relPath == "." {
-				return nil
-			}
+	fmt.Printf("\nSummary: %d files checked, %d missing, %d extra, %d differ in size, %d differ in time",
+		report.Checked, len(report.Missing), len(report.Extra), len(report.Size), len(report.Time))
+	if *checksum {
+		fmt.Printf(", %d differ in content", len(report.Content))
+	}
+	fmt.Printf("\n")
 
-			sourceItems[relPath] = true
-			return nil
-		})
-		if err != nil {
-			return fmt.Errorf("failed to walk source directory '%s': %w", src, err)
+	differences := len(report.Missing) + len(report.Extra) + len(report.Size) + len(report.Time) + len(report.Content)
+	if differences > 0 {
+		return &exitError{
+			code: ExitDifferent,
+			err:  fmt.Errorf("destination differs from the source (%d differences)", differences),
 		}
-	} else {
-		// For single files, we just check if the destination file matches
-		return nil // No extra files to handle for single file copy
 	}
+	fmt.Printf("Destination matches the source\n")
+	return nil
+}
 
-	// Now check destination for extra files
-	var extraFiles []string
-	var extraDirs []string
-
-	err = filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+// verifyTree compares the copy of src at dst, printing every difference and adding it to report.
+// Files are compared like needsUpdate does, and by content when checksum is set.
+func verifyTree(src, dst string, checksum bool, opts *CopyOptions, report *VerifyReport) error {
+	err := walkSource(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			// If we can't access a file, skip it but don't fail
-			return nil
+			return opFailed("stat", path, fmt.Errorf("failed to get source info for '%s': %w", path, err))
 		}
 
-		// Get relative path from destination root
-		relPath, err := filepath.Rel(dst, path)
+		relPath, err := filepath.Rel(src, path)
 		if err != nil {
 			return err
 		}
-
-		// Skip the root directory itself
-		if relPath == "." {
-			return nil
+		target := dst
+		if relPath != "." {
+			// Metadata that is not copied has no copy to compare with
+			if skipsMetadata(info.Name(), opts) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			target = filepath.Join(dst, normalizeName(relPath, opts))
 		}
 
-		// Check if this item exists in source
-		if !sourceItems[relPath] {
+		dstInfo, err := os.Stat(target)
+		if err != nil && !os.IsNotExist(err) {
+			return opFailed("stat", target, fmt.Errorf("failed to get destination info for '%s': %w", target, err))
+		}
+		if err != nil || dstInfo.IsDir() != info.IsDir() {
+			fmt.Printf("MISSING: %s\n", path)
+			report.Missing = append(report.Missing, path)
 			if info.IsDir() {
-				extraDirs = append(extraDirs, path)
-				// Skip walking inside this directory since we'll delete it entirely
 				return filepath.SkipDir
-			} else {
-				extraFiles = append(extraFiles, path)
-
-				// Add to statistics
-				stats.ExtraFound++
-				stats.ExtraBytes += info.Size()
 			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
 		}
 
+		report.Checked++
+		if info.Size() != dstInfo.Size() {
+			fmt.Printf("SIZE DIFFERS: %s (%d bytes, copy has %d bytes)\n", path, info.Size(), dstInfo.Size())
+			report.Size = append(report.Size, path)
+			return nil
+		}
+		if checksum {
+			srcSum, err := hashFile(path, false)
+			if err != nil {
+				return err
+			}
+			dstSum, err := hashFile(target, false)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(srcSum, dstSum) {
+				fmt.Printf("CONTENT DIFFERS: %s\n", path)
+				report.Content = append(report.Content, path)
+				return nil
+			}
+		}
+		if !sameModTime(info.ModTime(), dstInfo.ModTime()) {
+			fmt.Printf("TIME DIFFERS: %s (%s, copy has %s)\n", path,
+				info.ModTime().Format(time.DateTime), dstInfo.ModTime().Format(time.DateTime))
+			report.Time = append(report.Time, path)
+		}
 		return nil
 	})
-
 	if err != nil {
-		return fmt.Errorf("failed to walk destination directory '%s': %w", dst, err)
+		return err
 	}
 
-	// Add directory statistics
-	for range extraDirs {
-		stats.ExtraFound++
+	// A missing destination directory has no extras
+	if dstInfo, err := os.Stat(dst); err != nil || !dstInfo.IsDir() {
+		return nil
 	}
-
-	// Report extra files found
-	if len(extraFiles) > 0 || len(extraDirs) > 0 {
+	extras, err := findExtraFiles(src, dst, opts)
+	if err != nil {
+		return err
+	}
+	for _, path := range append(extras.Files, extras.Dirs...) {
+		fmt.Printf("EXTRA: %s\n", path)
+		report.Extra = append(report.Extra, path)
+	}
+	return nil
+}
+
+// hashFile returns the SHA-256 hash of the contents of path. With fromDevice the file is
+// dropped from the page cache first, so the data is read from the device.
+func hashFile(path string, fromDevice bool) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, opFailed("open", path, fmt.Errorf("failed to open '%s': %w", path, err))
+	}
+	defer file.Close()
+
+	// Cached pages would hide decay of the data on the device
+	if fromDevice {
+		dropCache(file)
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, opFailed("read", path, fmt.Errorf("failed to read '%s': %w", path, err))
+	}
+	return hasher.Sum(nil), nil
+}
+
+// manifestName is the file at the destination root that lists the copied files (--manifest)
+const manifestName = ".smartcopy.sha256"
+
+// ManifestEntry describes one file in the manifest
+type ManifestEntry struct {
+	Size    int64
+	ModTime time.Time
+	Sum     string // SHA-256 of the contents, hex encoded
+}
+
+// manifestLogName is the file next to the manifest that lists the files hashed by a run as they
+// complete, so a run that is killed before it writes the manifest does not lose them
+const manifestLogName = manifestName + ".log"
+
+// Manifest records the size, modification time and SHA-256 of every file copied to a destination.
+// It is written in the sha256sum format, with the size and time in a comment before each hash,
+// so `sha256sum -c` can check it from the destination root.
+type Manifest struct {
+	Root     string                   // Destination root; entry paths are relative to it
+	Entries  map[string]ManifestEntry // Files seen in this run, by slash-separated relative path
+	previous map[string]ManifestEntry // Entries whose hashes are reused for files that did not change
+	existing map[string]ManifestEntry // Entries already listed for the destination root
+	targets  []string                 // Relative paths copied by this run; entries below them are replaced
+	log      *os.File                 // Log of the hashes of this run (nil until the first one)
+	saved    bool                     // The manifest was written
+}
+
+// loadManifest prepares the manifest of root for a run copying to targets. Hashes are reused
+// from the manifest in from (root itself, or the previous snapshot), and from the log of an
+// interrupted run in root. Entries outside the targets are kept, so runs copying different
+// sources into the same destination all stay listed.
+func loadManifest(root, from string, targets []string) (*Manifest, error) {
+	m := &Manifest{Root: root, Entries: make(map[string]ManifestEntry)}
+	for _, target := range targets {
+		rel, err := m.relPath(target)
+		if err != nil {
+			return nil, err
+		}
+		m.targets = append(m.targets, rel)
+	}
+
+	var err error
+	if m.existing, err = readManifest(filepath.Join(root, manifestName)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if m.existing == nil {
+		m.existing = make(map[string]ManifestEntry)
+	}
+	m.previous = m.existing
+	if from != root {
+		if m.previous, err = readManifest(filepath.Join(from, manifestName)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if m.previous == nil {
+			m.previous = make(map[string]ManifestEntry)
+		}
+	}
+
+	// The log of an interrupted run holds hashes newer than the manifest
+	logged, err := readManifest(filepath.Join(root, manifestLogName))
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("WARNING: Ignoring the hashes of an interrupted run: %v\n", err)
+	}
+	for name, entry := range logged {
+		m.existing[name] = entry
+		m.previous[name] = entry
+	}
+	return m, nil
+}
+
+// readManifest parses a manifest file. Hash lines without a size and time comment
+// (as written by sha256sum itself) are returned with a zero Size and ModTime.
+func readManifest(path string) (map[string]ManifestEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]ManifestEntry)
+	var pending ManifestEntry
+	for i, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if strings.HasPrefix(line, "#") {
+			pending = ManifestEntry{}
+			var mtime string
+			if _, err := fmt.Sscanf(line, "# size=%d mtime=%s", &pending.Size, &mtime); err == nil {
+				pending.ModTime, _ = time.Parse(time.RFC3339Nano, mtime)
+			}
+			continue
+		}
+
+		// sha256sum marks names containing a backslash or newline with a leading backslash
+		escaped := strings.HasPrefix(line, "\\")
+		line = strings.TrimPrefix(line, "\\")
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok || len(sum) != sha256.Size*2 {
+			return nil, fmt.Errorf("malformed manifest line %d in '%s'", i+1, path)
+		}
+		if escaped {
+			name = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(name)
+		}
+		pending.Sum = strings.ToLower(sum)
+		entries[name] = pending
+		pending = ManifestEntry{}
+	}
+	return entries, nil
+}
+
+// writeManifestEntry writes the comment and hash lines of one entry
+func writeManifestEntry(b *strings.Builder, name string, entry ManifestEntry) {
+	fmt.Fprintf(b, "# size=%d mtime=%s\n", entry.Size, entry.ModTime.UTC().Format(time.RFC3339Nano))
+	if strings.ContainsAny(name, "\\\n") {
+		name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+		b.WriteString("\\")
+	}
+	fmt.Fprintf(b, "%s  %s\n", entry.Sum, name)
+}
+
+// record adds the copy at dst with the hash computed while copying it
+func (m *Manifest) record(dst string, sum []byte) error {
+	info, err := os.Stat(dst)
+	if err != nil {
+		return opFailed("stat", dst, fmt.Errorf("failed to get destination file info for '%s': %w", dst, err))
+	}
+	rel, err := m.relPath(dst)
+	if err != nil {
+		return err
+	}
+	return m.add(rel, ManifestEntry{Size: info.Size(), ModTime: info.ModTime(), Sum: hex.EncodeToString(sum)})
+}
+
+// recordExisting adds a file that was already up to date. Its earlier entry is kept when the
+// file has not changed since; otherwise the file is hashed.
+func (m *Manifest) recordExisting(dst string) error {
+	info, err := os.Stat(dst)
+	if err != nil {
+		return opFailed("stat", dst, fmt.Errorf("failed to get destination file info for '%s': %w", dst, err))
+	}
+	rel, err := m.relPath(dst)
+	if err != nil {
+		return err
+	}
+	if entry, ok := m.previous[rel]; ok && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		m.Entries[rel] = entry
+		return nil
+	}
+
+	sum, err := hashFile(dst, false)
+	if err != nil {
+		return err
+	}
+	return m.add(rel, ManifestEntry{Size: info.Size(), ModTime: info.ModTime(), Sum: hex.EncodeToString(sum)})
+}
+
+// add lists a newly hashed file and appends it to the log right away
+func (m *Manifest) add(rel string, entry ManifestEntry) error {
+	m.Entries[rel] = entry
+	path := filepath.Join(m.Root, manifestLogName)
+	if m.log == nil {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return opFailed("manifest", path, fmt.Errorf("failed to open manifest log '%s': %w", path, err))
+		}
+		m.log = file
+	}
+	var b strings.Builder
+	writeManifestEntry(&b, rel, entry)
+	if _, err := m.log.WriteString(b.String()); err != nil {
+		return opFailed("manifest", path, fmt.Errorf("failed to write manifest log '%s': %w", path, err))
+	}
+	return nil
+}
+
+// relPath returns the manifest name of dst: its slash-separated path relative to the root
+func (m *Manifest) relPath(dst string) (string, error) {
+	rel, err := filepath.Rel(m.Root, dst)
+	if err != nil {
+		return "", fmt.Errorf("failed to place '%s' in the manifest of '%s': %w", dst, m.Root, err)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// inTargets reports whether the entry name is below one of the paths copied by this run
+func (m *Manifest) inTargets(name string) bool {
+	for _, target := range m.targets {
+		if target == "." || name == target || strings.HasPrefix(name, target+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the entries of this run to the manifest, together with the earlier entries it
+// did not replace, and removes the log. When the run completed, earlier entries below its
+// targets are dropped, as those files were seen again if they are still there. An aborted run
+// keeps them, as it may not have reached them.
+// With a journal, the previous manifest is kept so undo can restore it.
+func (m *Manifest) save(journal *Journal, completed bool) error {
+	m.saved = true
+	entries := make(map[string]ManifestEntry, len(m.Entries))
+	for name, entry := range m.existing {
+		if !completed || !m.inTargets(name) {
+			entries[name] = entry
+		}
+	}
+	for name, entry := range m.Entries {
+		entries[name] = entry
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("# smartcopy manifest: size and modification time of each file, followed by its SHA-256\n")
+	b.WriteString("# check with: sha256sum -c " + manifestName + "\n")
+	for _, name := range names {
+		writeManifestEntry(&b, name, entries[name])
+	}
+
+	// Write a temporary file first so an interrupted run never leaves a truncated manifest
+	path := filepath.Join(m.Root, manifestName)
+	if err := os.MkdirAll(m.Root, 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory '%s': %w", m.Root, err)
+	}
+	if err := os.WriteFile(path+".tmp", []byte(b.String()), 0644); err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("failed to write manifest '%s': %w", path, err)
+	}
+	op := "create"
+	if journal != nil {
+		if _, err := os.Lstat(path); err == nil {
+			if err := journal.preserve(path); err != nil {
+				return err
+			}
+			op = "replace"
+		}
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write manifest '%s': %w", path, err)
+	}
+	if journal != nil {
+		if err := journal.record(op, path); err != nil {
+			return err
+		}
+	}
+
+	// Everything in the log is in the manifest now
+	if m.log != nil {
+		m.log.Close()
+		m.log = nil
+	}
+	if err := os.Remove(filepath.Join(m.Root, manifestLogName)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove manifest log: %w", err)
+	}
+	fmt.Printf("Manifest: %d files listed in %s\n", len(names), path)
+	return nil
+}
+
+// ScrubReport collects the results of the scrub command
+type ScrubReport struct {
+	Checked    int      // Manifest entries checked
+	Modified   []string // Files changed since the manifest was written, with a new modification time or size
+	Corrupt    []string // Files whose contents changed while their size and time did not (bit rot)
+	Unreadable []string // Files that could not be read
+	Missing    []string // Files listed in the manifest that no longer exist
+	Repaired   []string // Corrupt or unreadable files restored from the source
+}
+
+// runScrub implements the scrub command: it rereads every file listed in the manifest of a
+// destination and compares it with the recorded hash, optionally repairing it from the source
+func runScrub(args []string) error {
+	flags := flag.NewFlagSet("scrub", flag.ExitOnError)
+	var source = flags.String("source", "", "original source directory to repair corrupt and unreadable files from")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s scrub [options] <destination>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nRereads every file listed in the destination's %s and reports\n", manifestName)
+		fmt.Fprintf(os.Stderr, "files whose contents changed without their modification time changing.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = flags.Args()
+
+	if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected exactly one destination")
+	}
+	destination := args[0]
+	if *source != "" {
+		if info, err := os.Stat(*source); err != nil {
+			return fmt.Errorf("failed to get source info for '%s': %w", *source, err)
+		} else if !info.IsDir() {
+			return fmt.Errorf("source '%s' is not a directory", *source)
+		}
+	}
+
+	entries, err := readManifest(filepath.Join(destination, manifestName))
+	if err != nil {
+		return fmt.Errorf("failed to read the manifest of '%s' (was it copied with --manifest?): %w", destination, err)
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report := &ScrubReport{}
+	for _, name := range names {
+		scrubFile(destination, name, entries[name], *source, report)
+	}
+
+	fmt.Printf("\nSummary: %d files scrubbed, %d modified, %d corrupt, %d unreadable, %d missing",
+		report.Checked, len(report.Modified), len(report.Corrupt), len(report.Unreadable), len(report.Missing))
+	if *source != "" {
+		fmt.Printf(", %d repaired", len(report.Repaired))
+	}
+	fmt.Printf("\n")
+
+	damaged := len(report.Corrupt) + len(report.Unreadable) + len(report.Missing) - len(report.Repaired)
+	if damaged > 0 {
+		return &exitError{
+			code: ExitCorrupt,
+			err:  fmt.Errorf("%d files in '%s' are corrupt, unreadable or missing", damaged, destination),
+		}
+	}
+	return nil
+}
+
+// scrubFile checks one manifest entry and adds the outcome to report. A corrupt or unreadable
+// file is repaired when a source is given and the source file still has the recorded hash.
+func scrubFile(destination, name string, entry ManifestEntry, source string, report *ScrubReport) {
+	path := filepath.Join(destination, filepath.FromSlash(name))
+	report.Checked++
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		fmt.Printf("%s (MISSING)\n", path)
+		report.Missing = append(report.Missing, path)
+		return
+	}
+
+	var sum []byte
+	if err == nil {
+		sum, err = hashFile(path, true)
+	}
+	switch {
+	case err != nil:
+		fmt.Printf("%s (UNREADABLE - %v)", path, err)
+		report.Unreadable = append(report.Unreadable, path)
+	case hex.EncodeToString(sum) == entry.Sum:
+		fmt.Printf("%s (ok)\n", path)
+		return
+	case !entry.ModTime.IsZero() && (info.Size() != entry.Size || !info.ModTime().Equal(entry.ModTime)):
+		// Changed by someone on purpose after the copy; not something to repair
+		fmt.Printf("%s (MODIFIED - changed after the manifest was written)\n", path)
+		report.Modified = append(report.Modified, path)
+		return
+	default:
+		fmt.Printf("%s (CORRUPT - contents changed but modification time did not)", path)
+		report.Corrupt = append(report.Corrupt, path)
+	}
+
+	if source == "" {
+		fmt.Printf("\n")
+		return
+	}
+	if err := repairFile(sourceCandidates(source, name), path, entry); err != nil {
+		fmt.Printf(" (repair FAILED: %v)\n", err)
+		return
+	}
+	fmt.Printf(" (REPAIRED from source)\n")
+	report.Repaired = append(report.Repaired, path)
+}
+
+// sourceCandidates returns where the source file of the manifest entry name may be. Manifest
+// paths are relative to the destination root, so a source copied into the destination as a
+// directory (smartcopy photos archive) has its own name as the first component. The path with
+// that component dropped is tried first, then the path as it is (smartcopy photos/. archive).
+func sourceCandidates(source, name string) []string {
+	var candidates []string
+	first, rest, found := strings.Cut(name, "/")
+	if abs, err := filepath.Abs(source); err == nil && found && first == filepath.Base(abs) {
+		candidates = append(candidates, filepath.Join(source, filepath.FromSlash(rest)))
+	}
+	return append(candidates, filepath.Join(source, filepath.FromSlash(name)))
+}
+
+// repairFile copies the first of the source candidates that still has the hash recorded in the
+// manifest over the damaged file dst, and restores the recorded modification time so the
+// manifest stays valid
+func repairFile(candidates []string, dst string, entry ManifestEntry) error {
+	var src string
+	var srcInfo os.FileInfo
+	var srcSum []byte
+	var firstErr error
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate)
+		if err != nil {
+			err = fmt.Errorf("failed to get source info for '%s': %w", candidate, err)
+		} else if srcSum, err = hashFile(candidate, false); err == nil && hex.EncodeToString(srcSum) != entry.Sum {
+			err = fmt.Errorf("source '%s' no longer matches the manifest", candidate)
+		}
+		if err == nil {
+			src, srcInfo = candidate, info
+			break
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if src == "" {
+		return firstErr
+	}
+
+	if _, _, _, err := copyFileContents(src, dst, srcInfo, &CopyOptions{}, nil, nil); err != nil {
+		return err
+	}
+	if !entry.ModTime.IsZero() {
+		if err := os.Chtimes(dst, entry.ModTime, entry.ModTime); err != nil {
+			return fmt.Errorf("failed to set file times for '%s': %w", dst, err)
+		}
+	}
+	return verifyFile(dst, srcSum, nil)
+}
+
+// Layout of the probe test data: files of probeFileSize bytes written in chunks of
+// probeChunkSize, checked in sectors of probeSectorSize that each carry their own offset
+const (
+	probeDirName    = ".smartcopy-probe"
+	probeFileSize   = 1 << 30
+	probeChunkSize  = 1 << 20
+	probeSectorSize = 4096
+)
+
+// ProbeReport collects the results of the probe command
+type ProbeReport struct {
+	Written     int64 // Bytes of test data written
+	Good        int64 // Bytes that read back correctly
+	Overwritten int64 // Bytes that read back as test data of another offset (wrapped addresses)
+	Corrupted   int64 // Bytes that read back as anything else
+	FirstBad    int64 // Offset of the first bad sector, or -1 when all data read back correctly
+}
+
+// runProbe implements the probe command: it fills the free space of a destination with test
+// data, reads it back to find the capacity that really works, and removes the test data again.
+// Counterfeit drives report a large size but wrap around after their real capacity, so data
+// written past it overwrites earlier data.
+func runProbe(args []string) error {
+	flags := flag.NewFlagSet("probe", flag.ExitOnError)
+	var limit = flags.Int64("limit", 0, "stop after writing this many MiB of test data (0 fills all free space)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s probe [options] <destination>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nWrites test data to the free space of the destination, reads it back to find\n")
+		fmt.Fprintf(os.Stderr, "the real usable capacity and any corruption, then removes the test data.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = flags.Args()
+
+	if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected exactly one destination")
+	}
+	if *limit < 0 {
+		return fmt.Errorf("invalid --limit value %d (must be 0 or more)", *limit)
+	}
+	destination := args[0]
+	if info, err := os.Stat(destination); err != nil {
+		return fmt.Errorf("failed to get destination info for '%s': %w", destination, err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("destination '%s' is not a directory", destination)
+	}
+
+	if free, err := diskFree(destination); err == nil {
+		fmt.Printf("Free space reported: %s\n", formatBytes(int64(free)))
+	}
+
+	// Test data of an earlier, interrupted probe is removed first
+	dir := filepath.Join(destination, probeDirName)
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove old test data '%s': %w", dir, err)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create test directory '%s': %w", dir, err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			fmt.Printf("WARNING: Failed to remove test data '%s': %v\n", dir, err)
+		} else {
+			fmt.Printf("Removed test data %s\n", dir)
+		}
+	}()
+
+	seed := uint64(time.Now().UnixNano())
+	fmt.Printf("\nWriting test data...\n")
+	files, written, err := writeProbeFiles(dir, seed, *limit<<20)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nReading test data back...\n")
+	report := &ProbeReport{Written: written, FirstBad: -1}
+	for i, file := range files {
+		if err := checkProbeFile(file, int64(i)*probeFileSize, seed, report); err != nil {
+			return err
+		}
+	}
+
+	usable := report.Written
+	if report.FirstBad >= 0 {
+		usable = report.FirstBad
+	}
+	fmt.Printf("\nSummary: %s written, %s read back correctly, %s overwritten, %s corrupted\n",
+		formatBytes(report.Written), formatBytes(report.Good), formatBytes(report.Overwritten), formatBytes(report.Corrupted))
+	fmt.Printf("Usable capacity: %s of %s tested\n", formatBytes(usable), formatBytes(report.Written))
+
+	if report.FirstBad >= 0 {
+		fmt.Printf("WARNING: data written after the first %s does not read back correctly.\n", formatBytes(usable))
+		if report.Overwritten > 0 {
+			fmt.Printf("Later data overwrote earlier data: the drive is probably smaller than it claims.\n")
+		}
+		return &exitError{
+			code: ExitProbeFailed,
+			err:  fmt.Errorf("'%s' lost %s of test data; do not trust it with backups", destination, formatBytes(report.Overwritten+report.Corrupted)),
+		}
+	}
+	return nil
+}
+
+// writeProbeFiles fills dir with test files until the destination is full or limit bytes
+// (when not 0) are written, and returns the files and the total bytes written
+func writeProbeFiles(dir string, seed uint64, limit int64) ([]string, int64, error) {
+	var files []string
+	var total int64
+	buf := make([]byte, probeChunkSize)
+	for full := false; !full && (limit == 0 || total < limit); {
+		path := filepath.Join(dir, fmt.Sprintf("probe-%04d.dat", len(files)+1))
+		file, err := os.Create(path)
+		if err != nil {
+			if isDiskFull(err) {
+				break
+			}
+			return nil, 0, opFailed("create", path, fmt.Errorf("failed to create test file '%s': %w", path, err))
+		}
+		files = append(files, path)
+
+		startTime := time.Now()
+		var written int64
+		for written < probeFileSize && (limit == 0 || total+written < limit) {
+			chunk := buf
+			if limit > 0 && limit-total-written < int64(len(chunk)) {
+				chunk = chunk[:limit-total-written]
+			}
+			fillProbeData(chunk, total+written, seed)
+			n, err := file.Write(chunk)
+			written += int64(n)
+			if isDiskFull(err) {
+				full = true
+				break
+			}
+			if err != nil {
+				file.Close()
+				return nil, 0, opFailed("copy", path, fmt.Errorf("failed to write test file '%s': %w", path, err))
+			}
+		}
+
+		// Data must reach the device before it can be checked
+		if err := file.Sync(); err != nil && !isDiskFull(err) {
+			file.Close()
+			return nil, 0, opFailed("sync", path, fmt.Errorf("failed to flush test file '%s': %w", path, err))
+		}
+		file.Close()
+		total += written
+		fmt.Printf("%s (%d bytes written, %s)\n", path, written, formatSpeed(float64(written)/time.Since(startTime).Seconds()))
+	}
+	return files, total, nil
+}
+
+// fillProbeData fills b with the test data for the given offset. Every sector starts with its
+// own offset and the seed, followed by pseudo-random data derived from both.
+func fillProbeData(b []byte, offset int64, seed uint64) {
+	var sector [probeSectorSize]byte
+	for start := 0; start < len(b); start += probeSectorSize {
+		probeSector(sector[:], uint64(offset)+uint64(start), seed)
+		copy(b[start:], sector[:])
+	}
+}
+
+// probeSector fills one sector of test data (xorshift64* seeded with offset and seed)
+func probeSector(sector []byte, offset, seed uint64) {
+	binary.LittleEndian.PutUint64(sector[0:], offset)
+	binary.LittleEndian.PutUint64(sector[8:], seed)
+	state := seed ^ (offset+1)*0x9E3779B97F4A7C15
+	for i := 16; i < len(sector); i += 8 {
+		state ^= state >> 12
+		state ^= state << 25
+		state ^= state >> 27
+		binary.LittleEndian.PutUint64(sector[i:], state*0x2545F4914F6CDD1D)
+	}
+}
+
+// checkProbeFile reads a test file back from the device and adds every sector to report
+func checkProbeFile(path string, offset int64, seed uint64, report *ProbeReport) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return opFailed("open", path, fmt.Errorf("failed to open test file '%s': %w", path, err))
+	}
+	defer file.Close()
+	dropCache(file)
+
+	startTime := time.Now()
+	var good, bad int64
+	buf := make([]byte, probeChunkSize)
+	expected := make([]byte, probeSectorSize)
+	other := make([]byte, probeSectorSize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		for start := 0; start < n; start += probeSectorSize {
+			sector := buf[start:min(start+probeSectorSize, n)]
+			at := offset + good + bad
+			probeSector(expected, uint64(at), seed)
+			if bytes.Equal(sector, expected[:len(sector)]) {
+				good += int64(len(sector))
+				continue
+			}
+
+			// Test data of another offset means the drive mapped two offsets to the same place
+			bad += int64(len(sector))
+			wrapped := false
+			if len(sector) >= 16 && binary.LittleEndian.Uint64(sector[8:]) == seed {
+				probeSector(other, binary.LittleEndian.Uint64(sector), seed)
+				wrapped = bytes.Equal(sector, other[:len(sector)])
+			}
+			if wrapped {
+				report.Overwritten += int64(len(sector))
+			} else {
+				report.Corrupted += int64(len(sector))
+			}
+			if report.FirstBad < 0 {
+				report.FirstBad = at
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return opFailed("read", path, fmt.Errorf("failed to read test file '%s': %w", path, err))
+		}
+	}
+	report.Good += good
+
+	speed := formatSpeed(float64(good+bad) / time.Since(startTime).Seconds())
+	if bad > 0 {
+		fmt.Printf("%s (%s BAD, %s)\n", path, formatBytes(bad), speed)
+	} else {
+		fmt.Printf("%s (ok, %s)\n", path, speed)
+	}
+	return nil
+}
+
+// targetPathFor returns where a source is copied to: inside the destination directory
+// (standard cp behavior), or as the destination itself
+func targetPathFor(source, destination string, intoDest bool, opts *CopyOptions) string {
+	if intoDest {
+		return filepath.Join(destination, normalizeName(filepath.Base(source), opts))
+	}
+	return destination
+}
+
+// realPath returns the absolute path with symlinks resolved in the longest existing prefix,
+// so that paths which do not exist yet can still be compared
+func realPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for {
+		if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		parent := filepath.Dir(abs)
+		if parent == abs {
+			return filepath.Join(abs, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(abs), rest)
+		abs = parent
+	}
+}
+
+// isWithin reports whether path is dir itself or lies below it. Each existing ancestor is
+// compared by device and inode, so symlinks and bind mounts are recognized as well.
+func isWithin(path string, dir os.FileInfo) bool {
+	resolved, err := realPath(path)
+	if err != nil {
+		return false
+	}
+	for p := resolved; ; p = filepath.Dir(p) {
+		if info, err := os.Stat(p); err == nil && os.SameFile(info, dir) {
+			return true
+		}
+		if filepath.Dir(p) == p {
+			return false
+		}
+	}
+}
+
+// checkOverlap is run before anything is written. It refuses to copy a file onto itself
+// (including hard links, which O_TRUNC would empty) or a directory onto itself or into a
+// destination that contains it. A destination inside a source directory is created and
+// added to opts.Exclude so that the copy does not descend into it endlessly.
+func checkOverlap(sources []string, destination string, intoDest bool, opts *CopyOptions) error {
+	for _, source := range sources {
+		srcInfo, err := os.Stat(source)
+		if err != nil {
+			return fmt.Errorf("failed to get source info for '%s': %w", source, err)
+		}
+		target := targetPathFor(source, destination, intoDest, opts)
+		targetInfo, targetErr := os.Stat(target)
+
+		if targetErr == nil && os.SameFile(srcInfo, targetInfo) {
+			if srcInfo.IsDir() {
+				return fmt.Errorf("cannot copy directory '%s' onto itself ('%s')", source, target)
+			}
+			return fmt.Errorf("'%s' and '%s' are the same file", source, target)
+		}
+		if !srcInfo.IsDir() {
+			continue
+		}
+
+		if targetErr == nil && targetInfo.IsDir() && isWithin(source, targetInfo) {
+			return fmt.Errorf("cannot copy directory '%s' into '%s', which contains it", source, target)
+		}
+
+		if isWithin(destination, srcInfo) {
+			fmt.Printf("NOTE: destination '%s' is inside source '%s' and is excluded from the copy\n", destination, source)
+			if err := os.MkdirAll(destination, 0755); err != nil {
+				return fmt.Errorf("failed to create destination directory '%s': %w", destination, err)
+			}
+			destInfo, err := os.Stat(destination)
+			if err != nil {
+				return fmt.Errorf("failed to get destination info for '%s': %w", destination, err)
+			}
+			opts.Exclude = append(opts.Exclude, destInfo)
+		}
+	}
+	return nil
+}
+
+// isExcluded reports whether a source directory is one of the excluded destination directories
+func isExcluded(path string, opts *CopyOptions) bool {
+	if len(opts.Exclude) == 0 {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	for _, excluded := range opts.Exclude {
+		if os.SameFile(info, excluded) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyRecursively copies files and directories from src to dst recursively
+func copyRecursively(src, dst string, opts *CopyOptions, stats *CopyStats) error {
+	srcInfo, err := withWatchdogResult(src, opts, func(progress *ioProgress) (os.FileInfo, error) {
+		progress.step("stat")
+		info, err := os.Stat(src)
+		if err != nil {
+			return nil, opFailed("stat", src, fmt.Errorf("failed to get source info: %w", err))
+		}
+		return info, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if srcInfo.IsDir() {
+		return copyDirectory(src, dst, srcInfo, opts, stats)
+	}
+	return copyFile(src, dst, srcInfo, opts, stats)
+}
+
+// copyDirectory creates the destination directory and copies all contents
+func copyDirectory(src, dst string, srcInfo os.FileInfo, opts *CopyOptions, stats *CopyStats) error {
+	// Create destination directory with same permissions
+	if err := makeDirs(dst, srcInfo.Mode(), opts); err != nil {
+		return opFailed("mkdir", dst, fmt.Errorf("failed to create directory '%s': %w", dst, err))
+	}
+
+	// With --delete-during, the extras in this directory go before its contents are copied
+	if opts.DeleteDuring != "" {
+		if err := deleteExtrasIn(src, dst, opts, stats); err != nil {
+			return err
+		}
+	}
+
+	// Read directory entries
+	entries, err := withWatchdogResult(src, opts, func(progress *ioProgress) ([]os.DirEntry, error) {
+		progress.step("readdir")
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return nil, opFailed("readdir", src, fmt.Errorf("failed to read directory '%s': %w", src, err))
+		}
+		return entries, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Copy each entry recursively, tracking which source name claimed each destination name
+	claimed := make(map[string]string)
+	var appleDoubles []string
+	for _, entry := range entries {
+		srcPath := filepath.Join(src, entry.Name())
+		dstName := normalizeName(entry.Name(), opts)
+
+		if skipsMetadata(entry.Name(), opts) {
+			if opts.MacMetadata == "merge" && isAppleDouble(entry.Name()) && entry.Type().IsRegular() {
+				// Merged after the data files they belong to have been copied
+				appleDoubles = append(appleDoubles, entry.Name())
+				continue
+			}
+			fmt.Printf("%s (skipped - macOS metadata)\n", srcPath)
+			stats.MetaSkipped++
+			continue
+		}
+
+		if entry.IsDir() && isExcluded(srcPath, opts) {
+			fmt.Printf("%s (skipped - destination directory)\n", srcPath)
+			continue
+		}
+
+		if other, exists := claimed[dstName]; exists {
+			fmt.Printf("WARNING: '%s' collides with '%s' after %s normalization (skipped)\n",
+				srcPath, filepath.Join(src, other), opts.Normalize)
+			stats.Collisions++
+			continue
+		}
+		claimed[dstName] = entry.Name()
+		dstPath := filepath.Join(dst, dstName)
+
+		if err := copyRecursively(srcPath, dstPath, opts, stats); err != nil {
+			if err := recordFailure(srcPath, err, opts, stats); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range appleDoubles {
+		if err := mergeAppleDouble(src, dst, name, opts, stats); err != nil {
+			if err := recordFailure(filepath.Join(src, name), err, opts, stats); err != nil {
+				return err
+			}
+		}
+	}
+
+	// After all contents are copied, set directory times to a sanitized source time
+	m := sanitizeFATTime(srcInfo.ModTime())
+	if err := os.Chtimes(dst, m, m); err != nil {
+		return opFailed("chtimes", dst, fmt.Errorf("failed to set directory times for '%s': %w", dst, err))
+	}
+
+	return nil
+}
+
+// isMacMetadata reports whether a file name is platform metadata created by macOS
+func isMacMetadata(name string) bool {
+	return isAppleDouble(name) || macMetadataNames[name]
+}
+
+// skipsMetadata reports whether a source entry is metadata that the configured policy does not copy
+func skipsMetadata(name string, opts *CopyOptions) bool {
+	return isMacMetadata(name) && (opts.MacMetadata == "skip" || opts.MacMetadata == "merge")
+}
+
+// isAppleDouble reports whether a file name is an AppleDouble companion file ("._name")
+func isAppleDouble(name string) bool {
+	return strings.HasPrefix(name, "._") && len(name) > 2
+}
+
+// mergeAppleDouble stores the contents of the AppleDouble file "._name" in src as extended
+// attributes on the copied file in dst. If the data file is missing the AppleDouble file is
+// skipped, and if the destination cannot store the attributes (not at all, or not that large)
+// it is copied as a plain file and the attributes already set are removed again.
+func mergeAppleDouble(src, dst, name string, opts *CopyOptions, stats *CopyStats) error {
+	adPath := filepath.Join(src, name)
+	dataName := normalizeName(name[2:], opts)
+	targetPath := filepath.Join(dst, dataName)
+
+	if _, err := os.Lstat(filepath.Join(src, name[2:])); err != nil {
+		fmt.Printf("%s (skipped - macOS metadata without data file)\n", adPath)
+		stats.MetaSkipped++
+		return nil
+	}
+
+	data, err := os.ReadFile(adPath)
+	if err != nil {
+		return opFailed("read", adPath, fmt.Errorf("failed to read AppleDouble file '%s': %w", adPath, err))
+	}
+	attrs, err := parseAppleDouble(data)
+	if err != nil {
+		fmt.Printf("WARNING: '%s' is not a valid AppleDouble file (%v), skipped\n", adPath, err)
+		stats.MetaSkipped++
+		return nil
+	}
+
+	names := make([]string, 0, len(attrs))
+	for attrName := range attrs {
+		names = append(names, attrName)
+	}
+	sort.Strings(names)
+	for i, attrName := range names {
+		err := setXattr(targetPath, attrName, attrs[attrName])
+		if errors.Is(err, errXattrUnsupported) {
+			fmt.Printf("%s (destination cannot store the extended attributes - copying as file)\n", adPath)
+			for _, set := range names[:i] {
+				if err := removeXattr(targetPath, set); err != nil {
+					fmt.Printf("WARNING: Failed to remove extended attribute '%s' from '%s': %v\n", set, targetPath, err)
+				}
+			}
+			adInfo, err := os.Stat(adPath)
+			if err != nil {
+				return opFailed("stat", adPath, fmt.Errorf("failed to get source info: %w", err))
+			}
+			return copyFile(adPath, filepath.Join(dst, normalizeName(name, opts)), adInfo, opts, stats)
+		}
+		if err != nil {
+			return opFailed("xattr", targetPath, fmt.Errorf("failed to set extended attribute '%s' on '%s': %w", attrName, targetPath, err))
+		}
+	}
+
+	fmt.Printf("%s (merged into extended attributes of %s)\n", adPath, dataName)
+	stats.MetaMerged++
+	return nil
+}
+
+// parseAppleDouble extracts the resource fork, Finder info and extended attributes stored in
+// an AppleDouble file, keyed by their macOS attribute names
+func parseAppleDouble(data []byte) (map[string][]byte, error) {
+	const (
+		magic        = 0x00051607
+		resourceFork = 2
+		finderInfo   = 9
+	)
+	be := binary.BigEndian
+
+	if len(data) < 26 || be.Uint32(data[0:4]) != magic {
+		return nil, fmt.Errorf("bad header")
+	}
+
+	attrs := make(map[string][]byte)
+	count := int(be.Uint16(data[24:26]))
+	for i := 0; i < count; i++ {
+		pos := 26 + i*12
+		if pos+12 > len(data) {
+			return nil, fmt.Errorf("truncated entry table")
+		}
+		id := be.Uint32(data[pos : pos+4])
+		offset := int(be.Uint32(data[pos+4 : pos+8]))
+		length := int(be.Uint32(data[pos+8 : pos+12]))
+		if offset < 0 || length < 0 || offset+length > len(data) {
+			return nil, fmt.Errorf("entry %d out of range", id)
+		}
+		entry := data[offset : offset+length]
+
+		switch id {
+		case resourceFork:
+			if length > 0 {
+				attrs["com.apple.ResourceFork"] = entry
+			}
+		case finderInfo:
+			if len(entry) >= 32 && !allZero(entry[:32]) {
+				attrs["com.apple.FinderInfo"] = entry[:32]
+			}
+			// macOS appends its extended attributes to the Finder info entry
+			if err := parseAppleDoubleAttrs(data, offset+34, attrs); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return attrs, nil
+}
+
+// parseAppleDoubleAttrs reads the "ATTR" block that macOS stores after the Finder info.
+// Attribute data offsets in the block are relative to the start of the file.
+func parseAppleDoubleAttrs(data []byte, start int, attrs map[string][]byte) error {
+	be := binary.BigEndian
+	if start+36 > len(data) || string(data[start:start+4]) != "ATTR" {
+		return nil // No extended attributes stored
+	}
+
+	count := int(be.Uint16(data[start+34 : start+36]))
+	pos := start + 36
+	for i := 0; i < count; i++ {
+		if pos+11 > len(data) {
+			return fmt.Errorf("truncated attribute table")
+		}
+		offset := int(be.Uint32(data[pos : pos+4]))
+		length := int(be.Uint32(data[pos+4 : pos+8]))
+		nameLen := int(data[pos+10])
+		if pos+11+nameLen > len(data) || offset+length > len(data) {
+			return fmt.Errorf("attribute %d out of range", i)
+		}
+		name := strings.TrimRight(string(data[pos+11:pos+11+nameLen]), "\x00")
+		attrs[name] = data[offset : offset+length]
+
+		// Entries are aligned to 4 bytes
+		pos = (pos + 11 + nameLen + 3) &^ 3
+	}
+	return nil
+}
+
+// allZero reports whether all bytes in b are zero
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// formatBytes formats bytes with appropriate prefixes
+func formatBytes(bytes int64) string {
+	if bytes >= 1e9 {
+		return fmt.Sprintf("%.1fGB", float64(bytes)/1e9)
+	} else if bytes >= 1e6 {
+		return fmt.Sprintf("%.0fMB", float64(bytes)/1e6)
+	} else if bytes >= 1e3 {
+		return fmt.Sprintf("%.0fkB", float64(bytes)/1e3)
+	} else {
+		return fmt.Sprintf("%dB", bytes)
+	}
+}
+
+// formatSpeed formats bytes per second with appropriate prefixes
+func formatSpeed(bytesPerSec float64) string {
+	if bytesPerSec >= 1e9 {
+		return fmt.Sprintf("%.1fGB/s", bytesPerSec/1e9)
+	} else if bytesPerSec >= 1e6 {
+		return fmt.Sprintf("%.0fMB/s", bytesPerSec/1e6)
+	} else if bytesPerSec >= 1e3 {
+		return fmt.Sprintf("%.0fkB/s", bytesPerSec/1e3)
+	} else {
+		return fmt.Sprintf("%.0fB/s", bytesPerSec)
+	}
+}
+
+// loadProtectPatterns combines the --protect patterns with those read from file (if not empty).
+// The file has one pattern per line; blank lines and lines starting with # are ignored.
+func loadProtectPatterns(patterns []string, file string) ([]string, error) {
+	result := append([]string{}, patterns...)
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read protect patterns: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				result = append(result, line)
+			}
+		}
+	}
+	for _, pattern := range result {
+		if _, err := path.Match(strings.Trim(pattern, "/"), ""); err != nil {
+			return nil, fmt.Errorf("invalid protect pattern '%s': %w", pattern, err)
+		}
+	}
+	return result, nil
+}
+
+// isProtected reports whether the destination path rel (relative to the mirrored directory)
+// matches a protect pattern. A pattern without a slash matches a name at any depth, one with a
+// slash matches the whole relative path, and a trailing slash only matches directories.
+func isProtected(rel string, isDir bool, opts *CopyOptions) bool {
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range opts.Protect {
+		if strings.HasSuffix(pattern, "/") {
+			if !isDir {
+				continue
+			}
+			pattern = strings.TrimRight(pattern, "/")
+		}
+		name := path.Base(rel)
+		if strings.Contains(pattern, "/") {
+			name = rel
+			pattern = strings.TrimLeft(pattern, "/")
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// relTo returns path relative to root, or path itself when that is not possible
+func relTo(root, path string) string {
+	if rel, err := filepath.Rel(root, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+// containsProtected reports whether the directory dir, inside the mirrored directory dst,
+// holds any protected path
+func containsProtected(dir, dst string, opts *CopyOptions) bool {
+	if len(opts.Protect) == 0 {
+		return false
+	}
+	found := false
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || found {
+			return nil
+		}
+		if rel, err := filepath.Rel(dst, path); err == nil && path != dir && isProtected(rel, info.IsDir(), opts) {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found
+}
+
+// ExtraItems holds destination entries that have no counterpart in the source
+type ExtraItems struct {
+	Files      []string
+	Dirs       []string
+	Collisions []string // Entries that duplicate another name after normalization (also in Files or Dirs)
+	FileBytes  int64    // Total size of the extra files (not including contents of extra directories)
+}
+
+// findExtraFiles compares the destination tree with the source tree and returns the entries
+// that only exist in the destination. Extra directories are returned without their contents.
+func findExtraFiles(src, dst string, opts *CopyOptions) (*ExtraItems, error) {
+	return findExtras(src, dst, dst, opts, true)
+}
+
+// findExtras finds the extras in dst, a directory inside the mirrored directory root that protect
+// patterns are relative to. Unless recursive is set, only the entries directly in dst are checked.
+func findExtras(src, dst, root string, opts *CopyOptions, recursive bool) (*ExtraItems, error) {
+	extras := &ExtraItems{}
+
+	// Build a map of all files/directories that should exist in destination
+	sourceItems := make(map[string]bool)
+
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat source '%s': %w", src, err)
+	}
+
+	if !srcInfo.IsDir() {
+		// For single files, we just check if the destination file matches
+		return extras, nil // No extra files to handle for single file copy
+	}
+
+	err = walkSource(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Get relative path from source root
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		// Skip the root directory itself
+		if relPath == "." {
+			return nil
+		}
+
+		// Metadata that is not copied never counts as a source item
+		if skipsMetadata(info.Name(), opts) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Neither does a destination directory inside the source
+		if info.IsDir() && isExcluded(path, opts) {
+			return filepath.SkipDir
+		}
+
+		sourceItems[normalizeName(relPath, opts)] = true
+		if info.IsDir() && !recursive {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk source directory '%s': %w", src, err)
+	}
+
+	// Now check destination for extra files
+	err = filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// If we can't access a file, skip it but don't fail
+			return nil
+		}
+
+		// Get relative path from destination root
+		relPath, err := filepath.Rel(dst, path)
+		if err != nil {
+			return err
+		}
+
+		// Skip the root directory itself
+		if relPath == "." {
+			return nil
+		}
+
+		// Protected paths belong to the destination, whatever the source holds
+		if isProtected(relTo(root, path), info.IsDir(), opts) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// A manifest written by smartcopy belongs to the destination
+		if !info.IsDir() && (info.Name() == manifestName || info.Name() == manifestLogName) {
+			return nil
+		}
+
+		// So does the journal directory
+		if info.IsDir() && opts.Journal != nil && sameFile(path, filepath.Join(opts.DestRoot, journalDirName)) {
+			return filepath.SkipDir
+		}
+
+		// So do trash directories created for extras moved to the trash
+		if info.IsDir() && opts.Trash && (info.Name() == ".Trash" || strings.HasPrefix(info.Name(), ".Trash-")) {
+			return filepath.SkipDir
+		}
+
+		// So do the backup directories of this and earlier runs, and the directories leading to them
+		if info.IsDir() && opts.BackupRoot != "" && isWithin(opts.BackupRoot, info) {
+			if sameFile(path, opts.BackupRoot) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Destination metadata is neither reported nor deleted unless metadata is copied like any other file
+		if opts.MacMetadata != "copy" && isMacMetadata(info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Names that are not in the chosen normalization form still match their source item,
+		// unless the normalized name also exists as a separate entry (a duplicate left by an
+		// earlier run without normalization)
+		present := sourceItems[relPath]
+		if normalized := normalizeName(relPath, opts); normalized != relPath && sourceItems[normalized] {
+			present = true
+			twinInfo, err := os.Lstat(filepath.Join(dst, normalized))
+			if err == nil && !os.SameFile(info, twinInfo) {
+				present = false
+				extras.Collisions = append(extras.Collisions, path)
+			}
+		}
+
+		// Check if this item exists in source
+		if !present {
+			// An extra directory holding protected paths is not removed as a whole; its
+			// contents are checked one by one instead
+			if info.IsDir() && containsProtected(path, root, opts) {
+				return nil
+			}
+			if info.IsDir() {
+				extras.Dirs = append(extras.Dirs, path)
+				// Skip walking inside this directory since we'll delete it entirely
+				return filepath.SkipDir
+			} else {
+				extras.Files = append(extras.Files, path)
+				extras.FileBytes += info.Size()
+			}
+		}
+
+		if info.IsDir() && !recursive {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk destination directory '%s': %w", dst, err)
+	}
+
+	return extras, nil
+}
+
+// handleExtraFiles handles detection and optional deletion of extra files in destination
+func handleExtraFiles(src, dst string, syncOptions *SyncOptions, opts *CopyOptions, stats *CopyStats) error {
+	extras, err := findExtraFiles(src, dst, opts)
+	if err != nil {
+		return err
+	}
+	extraFiles := extras.Files
+	extraDirs := extras.Dirs
+
+	// Add to statistics
+	stats.ExtraFound += len(extraFiles) + len(extraDirs)
+	stats.ExtraBytes += extras.FileBytes
+
+	// Report names that collide after normalization; they are also treated as extras
+	if len(extras.Collisions) > 0 {
+		fmt.Printf("\nNames colliding after %s normalization in destination:\n", opts.Normalize)
+		for _, path := range extras.Collisions {
+			fmt.Printf("  DUPLICATE: %s\n", path)
+		}
+		stats.Collisions += len(extras.Collisions)
+	}
+
+	// Report extra files found
+	if len(extraFiles) > 0 || len(extraDirs) > 0 {
 		fmt.Printf("\nExtra files/directories found in destination:\n")
 		for _, file := range extraFiles {
 			fmt.Printf("  FILE: %s\n", file)
 		}
-		for _, dir := range extraDirs {
-			fmt.Printf("  DIR:  %s\n", dir)
+		for _, dir := range extraDirs {
+			fmt.Printf("  DIR:  %s\n", dir)
+		}
+	}
+
+	extraPaths := append(append([]string{}, extraFiles...), extraDirs...)
+	if syncOptions.Adopt {
+		return adoptExtras(src, dst, extraPaths, opts, stats)
+	}
+	if syncOptions.Review {
+		return reviewExtras(src, dst, extraPaths, bufio.NewReader(os.Stdin), opts, stats)
+	}
+	if syncOptions.DeleteExtra {
+		removeExtras(extraPaths, opts, stats)
+	}
+	return nil
+}
+
+// deleteExtrasIn removes the extras directly in the destination directory dst before the source
+// directory src is copied into it (--delete-during)
+func deleteExtrasIn(src, dst string, opts *CopyOptions, stats *CopyStats) error {
+	extras, err := findExtras(src, dst, opts.DeleteDuring, opts, false)
+	if err != nil {
+		return err
+	}
+	stats.ExtraFound += len(extras.Files) + len(extras.Dirs)
+	stats.ExtraBytes += extras.FileBytes
+	stats.Collisions += len(extras.Collisions)
+	for _, path := range extras.Collisions {
+		fmt.Printf("  DUPLICATE: %s\n", path)
+	}
+	for _, path := range append(extras.Files, extras.Dirs...) {
+		removeExtra(path, opts, stats)
+	}
+	return nil
+}
+
+// pruneEmptyDirectories removes the directories below root, the copy of src, that are empty,
+// deepest first, so that directories holding only empty directories go too. Directories that
+// are empty in the source, or hold something that is copied, are mirrored and stay, as do
+// protected directories and the directories smartcopy keeps in the destination.
+func pruneEmptyDirectories(src, root string, opts *CopyOptions, stats *CopyStats) {
+	sourceDirs := make(map[string]bool)
+	mirroredDirs(src, src, opts, sourceDirs)
+
+	var dirs []string
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || path == root {
+			return nil
+		}
+		if sourceDirs[relTo(root, path)] {
+			return nil
+		}
+		if isProtected(relTo(root, path), true, opts) ||
+			(opts.Journal != nil && sameFile(path, filepath.Join(opts.DestRoot, journalDirName))) ||
+			(opts.BackupRoot != "" && sameFile(path, opts.BackupRoot)) ||
+			(opts.Trash && (info.Name() == ".Trash" || strings.HasPrefix(info.Name(), ".Trash-"))) {
+			return filepath.SkipDir
+		}
+		dirs = append(dirs, path)
+		return nil
+	})
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		if entries, err := os.ReadDir(dir); err != nil || len(entries) > 0 {
+			continue
+		}
+		var err error
+		if opts.Journal != nil {
+			if err = opts.Journal.preserve(dir); err == nil {
+				err = opts.Journal.record("delete", dir)
+			}
+		} else {
+			err = os.Remove(dir)
+		}
+		if err != nil {
+			fmt.Printf("WARNING: Failed to remove empty directory '%s': %v\n", dir, err)
+			continue
+		}
+		fmt.Printf("PRUNED: %s\n", dir)
+		stats.DirsPruned++
+	}
+}
+
+// mirroredDirs adds dir and the directories below it that are mirrored to the destination to
+// dirs, by normalized path relative to src, and reports whether dir is one of them. A directory
+// is mirrored when it is empty in the source or holds something that is copied; one whose
+// contents are all skipped (such as a folder holding only .DS_Store) is not.
+func mirroredDirs(src, dir string, opts *CopyOptions, dirs map[string]bool) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	mirrored := len(entries) == 0
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if skipsMetadata(entry.Name(), opts) {
+			continue
+		}
+		// Follow symbolic links as the copy does
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !info.IsDir() {
+			mirrored = true
+			continue
+		}
+		if isExcluded(path, opts) {
+			continue
+		}
+		if mirroredDirs(src, path, opts, dirs) {
+			mirrored = true
+		}
+	}
+	if mirrored {
+		dirs[normalizeName(relTo(src, dir), opts)] = true
+	}
+	return mirrored
+}
+
+// removeExtras deletes extra files and directories from the destination, or moves them to the
+// backup directory, the trash or the journal when one is used
+func removeExtras(paths []string, opts *CopyOptions, stats *CopyStats) {
+	if len(paths) == 0 {
+		return
+	}
+	switch {
+	case opts.Trash:
+		fmt.Printf("\nMoving extra files/directories to the trash...\n")
+	case opts.Journal != nil:
+		fmt.Printf("\nMoving extra files/directories to the journal...\n")
+	case opts.BackupDir != "":
+		fmt.Printf("\nMoving extra files/directories to %s...\n", opts.BackupDir)
+	default:
+		fmt.Printf("\nDeleting extra files/directories...\n")
+	}
+
+	for _, path := range paths {
+		removeExtra(path, opts, stats)
+	}
+}
+
+// removeExtra deletes a single extra, or moves it where removeExtras would
+func removeExtra(path string, opts *CopyOptions, stats *CopyStats) {
+	var err error
+	switch {
+	case opts.Trash:
+		err = moveToTrash(path)
+	case opts.Journal != nil:
+		if err = opts.Journal.preserve(path); err == nil {
+			err = opts.Journal.record("delete", path)
+		}
+	case opts.BackupDir != "":
+		err = moveToBackup(path, opts)
+	default:
+		err = os.RemoveAll(path)
+	}
+	if err != nil {
+		fmt.Printf("  WARNING: Failed to remove '%s': %v\n", path, err)
+		return
+	}
+
+	stats.ExtraDeleted++
+	switch {
+	case opts.Trash:
+		stats.Trashed++
+	case opts.BackupDir != "":
+		stats.BackedUp++
+	}
+	if opts.Trash || opts.Journal != nil || opts.BackupDir != "" {
+		fmt.Printf("  MOVED: %s\n", path)
+	} else {
+		fmt.Printf("  DELETED: %s\n", path)
+	}
+}
+
+// copyBack copies an extra file or directory from the destination dst back to the same place
+// in the source src, refusing to overwrite anything that exists there
+func copyBack(path, src, dst string, opts *CopyOptions, stats *CopyStats) error {
+	rel, err := filepath.Rel(dst, path)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(src, rel)
+	if err := checkCopyBack(target); err != nil {
+		return err
+	}
+	// Names are copied back exactly as they are, with all metadata. The copy is not counted in
+	// the statistics of the run, which describe the destination.
+	backOpts := &CopyOptions{
+		Normalize:     "none",
+		MacMetadata:   "copy",
+		ChangeRetries: opts.ChangeRetries,
+		Retries:       opts.Retries,
+		RetryDelay:    opts.RetryDelay,
+		StallTimeout:  opts.StallTimeout,
+		Verify:        opts.Verify,
+	}
+	if err := copyRecursively(path, target, backOpts, &CopyStats{}); err != nil {
+		return err
+	}
+	stats.ExtraCopiedBack++
+	return nil
+}
+
+// checkCopyBack makes sure that target can be created in the source without replacing anything:
+// it must not exist, its parent must be a directory, and no entry there may have a name that only
+// differs from it in Unicode normalization
+func checkCopyBack(target string) error {
+	if _, err := os.Lstat(target); err == nil {
+		return fmt.Errorf("'%s' already exists in the source: %w", target, errCopyBackConflict)
+	}
+	parent := filepath.Dir(target)
+	info, err := os.Stat(parent)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' is not a directory in the source: %w", parent, errCopyBackConflict)
+	}
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		return err
+	}
+	name := norm.NFC.String(filepath.Base(target))
+	for _, entry := range entries {
+		if norm.NFC.String(entry.Name()) == name {
+			return fmt.Errorf("'%s' already exists in the source as '%s': %w", target, entry.Name(), errCopyBackConflict)
+		}
+	}
+	return nil
+}
+
+// adoptExtras copies every extra from the destination dst back into the source src and keeps it
+// in the destination. Extras that would replace anything in the source are reported as conflicts
+// and left alone.
+func adoptExtras(src, dst string, paths []string, opts *CopyOptions, stats *CopyStats) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	fmt.Printf("\nCopying extra files/directories back to the source...\n")
+
+	conflicts := 0
+	for _, path := range paths {
+		err := copyBack(path, src, dst, opts, stats)
+		if errors.Is(err, errCopyBackConflict) {
+			fmt.Printf("  CONFLICT: %v\n", err)
+			conflicts++
+			continue
+		}
+		if err := recordFailure(path, err, opts, stats); err != nil {
+			return err
+		}
+		if err == nil {
+			fmt.Printf("  ADOPTED: %s\n", path)
+		}
+	}
+	if conflicts > 0 {
+		fmt.Printf("%d extras were not adopted because the source already has an entry with the same name\n", conflicts)
+	}
+	return nil
+}
+
+// reviewExtras asks what to do with each extra, grouped by directory, and applies the choices
+// only after all extras have been reviewed. A choice can be applied to a whole directory and
+// everything below it. When input ends, the remaining extras are kept.
+func reviewExtras(src, dst string, paths []string, input *bufio.Reader, opts *CopyOptions, stats *CopyStats) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	sort.Strings(paths)
+
+	// Group the extras by the directory that holds them, with their sizes
+	groups := make(map[string][]string)
+	var order []string
+	sizes := make(map[string]int64)
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if _, ok := groups[dir]; !ok {
+			order = append(order, dir)
+		}
+		groups[dir] = append(groups[dir], path)
+		if info, err := os.Lstat(path); err == nil {
+			if info.IsDir() {
+				sizes[path] = dirSize(path)
+			} else {
+				sizes[path] = info.Size()
+			}
+		}
+	}
+	sort.Strings(order)
+
+	fmt.Printf("\nReview extra files/directories: [d]elete, [k]eep, [c]opy back to source, [q]uit (keep the rest)\n")
+	fmt.Printf("Upper case D, K or C applies the choice to everything in that directory and below.\n")
+
+	choices := make(map[string]byte)  // Choice for each extra
+	subtrees := make(map[string]byte) // Choices applied to directories and everything below
+	quit := false
+	for _, dir := range order {
+		var total int64
+		for _, path := range groups[dir] {
+			total += sizes[path]
+		}
+		fmt.Printf("\n%s (%d items, %s)\n", dir, len(groups[dir]), formatBytes(total))
+
+		for _, path := range groups[dir] {
+			kind := "FILE:"
+			if info, err := os.Lstat(path); err == nil && info.IsDir() {
+				kind = "DIR:"
+			}
+			label := fmt.Sprintf("  %-5s %s (%s)", kind, filepath.Base(path), formatBytes(sizes[path]))
+
+			// A choice made for an enclosing directory applies without asking
+			if choice, ok := subtreeChoice(path, subtrees); ok || quit {
+				if quit {
+					choice = 'k'
+				}
+				choices[path] = choice
+				fmt.Printf("%s -> %s\n", label, choiceName(choice))
+				continue
+			}
+
+			for {
+				fmt.Printf("%s [d/k/c/D/K/C/q]? ", label)
+				line, err := input.ReadString('\n')
+				answer := strings.TrimSpace(line)
+				if err != nil && answer == "" {
+					// No more input: keep everything that is left
+					fmt.Printf("\n")
+					answer = "q"
+				}
+				if answer == "q" {
+					quit = true
+					choices[path] = 'k'
+					break
+				}
+				if len(answer) == 1 && strings.Contains("dkc", strings.ToLower(answer)) {
+					choice := strings.ToLower(answer)[0]
+					choices[path] = choice
+					if answer[0] != choice {
+						subtrees[dir] = choice
+					}
+					break
+				}
+			}
+		}
+	}
+
+	// Apply the choices: copy back first, so nothing is deleted before it is safe in the source
+	var remove []string
+	var copied, kept int
+	for _, path := range paths {
+		switch choices[path] {
+		case 'c':
+			if err := copyBack(path, src, dst, opts, stats); err != nil {
+				if errors.Is(err, errCopyBackConflict) {
+					fmt.Printf("  CONFLICT: %v (kept)\n", err)
+					kept++
+					continue
+				}
+				if err := recordFailure(path, err, opts, stats); err != nil {
+					return err
+				}
+				fmt.Printf("  WARNING: Failed to copy '%s' back to the source: %v\n", path, err)
+				continue
+			}
+			copied++
+		case 'd':
+			remove = append(remove, path)
+		default:
+			kept++
+		}
+	}
+	removeExtras(remove, opts, stats)
+	removed := "removed"
+	if opts.Trash || opts.Journal != nil || opts.BackupDir != "" {
+		removed = "moved"
+	}
+	fmt.Printf("\nReviewed %d extras: %d copied back to source, %d %s, %d kept\n", len(paths), copied, len(remove), removed, kept)
+	return nil
+}
+
+// subtreeChoice returns the choice made for a directory that contains path, if any
+func subtreeChoice(path string, subtrees map[string]byte) (byte, bool) {
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if choice, ok := subtrees[dir]; ok {
+			return choice, true
+		}
+		if filepath.Dir(dir) == dir {
+			return 0, false
+		}
+	}
+}
+
+// choiceName describes a review choice
+func choiceName(choice byte) string {
+	switch choice {
+	case 'd':
+		return "delete"
+	case 'c':
+		return "copy back to source"
+	default:
+		return "keep"
+	}
+}
+
+// SpacePlan holds the result of the pre-flight scan of what a run will write
+type SpacePlan struct {
+	Files    int      // Files that need to be copied
+	Bytes    int64    // Bytes that will be written
+	Replaced int64    // Bytes of existing destination files that will be overwritten
+	Pending  []string // Source paths of the files that need to be copied
+}
+
+// planCopy walks src the same way copyRecursively does and records the files that needsUpdate
+// reports as out of date, without writing anything
+func planCopy(src, dst string, opts *CopyOptions, plan *SpacePlan) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("failed to get source info: %w", err)
+	}
+
+	if !srcInfo.IsDir() {
+		needsCopy, err := needsUpdate(src, dst, srcInfo)
+		if err != nil {
+			return err
+		}
+		if needsCopy && previousSnapshotCopy(src, dst, srcInfo, opts) == "" {
+			plan.Files++
+			plan.Bytes += srcInfo.Size()
+			plan.Pending = append(plan.Pending, src)
+			if dstInfo, err := os.Stat(dst); err == nil && !dstInfo.IsDir() {
+				plan.Replaced += dstInfo.Size()
+			}
+		}
+		return nil
+	}
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return fmt.Errorf("failed to read directory '%s': %w", src, err)
+	}
+	for _, entry := range entries {
+		srcPath := filepath.Join(src, entry.Name())
+		if skipsMetadata(entry.Name(), opts) || (entry.IsDir() && isExcluded(srcPath, opts)) {
+			continue
+		}
+		dstPath := filepath.Join(dst, normalizeName(entry.Name(), opts))
+		// With --keep-going, unreadable entries are reported when the copy reaches them
+		if err := planCopy(srcPath, dstPath, opts, plan); err != nil && !opts.KeepGoing {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkSource walks the tree at root like filepath.Walk, but follows symbolic links as
+// copyRecursively does, so that every entry is seen the way it is copied. A link that cannot
+// be followed is passed to fn as the link itself.
+func walkSource(root string, fn filepath.WalkFunc) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkSourceEntry(root, info, fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// walkSourceEntry calls fn for path and, for a directory, walks its entries
+func walkSourceEntry(path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if err := fn(path, info, nil); err != nil || !info.IsDir() {
+		return err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return fn(path, info, err)
+	}
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+		childInfo, err := os.Stat(child)
+		if err != nil {
+			childInfo, err = os.Lstat(child)
+		}
+		if err != nil {
+			err = fn(child, nil, err)
+		} else {
+			err = walkSourceEntry(child, childInfo, fn)
+		}
+		if err == filepath.SkipDir && childInfo != nil && childInfo.IsDir() {
+			continue
+		}
+		if err == filepath.SkipDir {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirSize returns the total size of all files below path
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// checkFreeSpace compares the bytes a run will write against the free space on the destination
+// filesystem and refuses to start when they do not fit. Files that are overwritten release their
+// old space while being copied; extras removed by -D only count when they are deleted before
+// copying (--delete-before).
+func checkFreeSpace(sources []string, destination string, intoDest bool, syncOptions *SyncOptions, opts *CopyOptions) error {
+	plan := &SpacePlan{}
+	for _, source := range sources {
+		if err := planCopy(source, targetPathFor(source, destination, intoDest, opts), opts, plan); err != nil && !opts.KeepGoing {
+			return err
+		}
+	}
+
+	// Replaced files only free their space when they are not kept in a backup directory
+	if opts.BackupDir != "" || opts.Journal != nil {
+		plan.Replaced = 0
+	}
+	needed := plan.Bytes - plan.Replaced
+	if needed <= 0 {
+		return nil
+	}
+
+	// Statfs needs an existing path, so use the nearest existing ancestor of the destination
+	existing := destination
+	for {
+		if _, err := os.Stat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+
+	free, err := diskFree(existing)
+	if err != nil {
+		fmt.Printf("WARNING: free space check skipped: %v\n", err)
+		return nil
+	}
+	if uint64(needed) <= free {
+		return nil
+	}
+
+	var extraBytes int64
+	if len(sources) == 1 && syncOptions.DeleteExtra && opts.BackupDir == "" && !opts.Trash && opts.Journal == nil {
+		extras, err := findExtraFiles(sources[0], targetPathFor(sources[0], destination, intoDest, opts), opts)
+		if err == nil {
+			extraBytes = extras.FileBytes
+			for _, dir := range extras.Dirs {
+				extraBytes += dirSize(dir)
+			}
+		}
+	}
+
+	if syncOptions.DeleteWhen == "before" && uint64(needed-extraBytes) <= free {
+		return nil
+	}
+
+	msg := fmt.Sprintf("not enough free space on destination '%s': %d files need %s", destination, plan.Files, formatBytes(plan.Bytes))
+	if plan.Replaced > 0 {
+		msg += fmt.Sprintf(" (%s after replacing existing files)", formatBytes(needed))
+	}
+	msg += fmt.Sprintf(", only %s available (short by %s)", formatBytes(int64(free)), formatBytes(needed-int64(free)))
+	if extraBytes > 0 && syncOptions.DeleteWhen == "before" {
+		msg += fmt.Sprintf("; deleting extras first only frees %s", formatBytes(extraBytes))
+	} else if extraBytes > 0 {
+		msg += fmt.Sprintf("; extras deleted by -D would free %s (use --delete-before to delete them first)", formatBytes(extraBytes))
+	}
+	return fmt.Errorf("%s; use --no-space-check to copy anyway", msg)
+}
+
+// showSummary displays the final statistics
+func showSummary(stats *CopyStats, syncOptions *SyncOptions) {
+	totalTime := time.Since(stats.StartTime)
+	overallSpeed := float64(stats.BytesCopied) / totalTime.Seconds()
+
+	fmt.Printf("\nSummary: %d files copied, %d files skipped, %s copied in %v (%s)",
+		stats.FilesCopied,
+		stats.FilesSkipped,
+		formatBytes(stats.BytesCopied),
+		totalTime.Round(time.Millisecond),
+		formatSpeed(overallSpeed))
+
+	// Add extra files information if sync options are enabled
+	if syncOptions.DetectExtra {
+		if syncOptions.DeleteExtra || syncOptions.Review {
+			fmt.Printf(", %d extra items deleted", stats.ExtraDeleted)
+		} else {
+			fmt.Printf(", %d extra items found", stats.ExtraFound)
+		}
+
+		if stats.ExtraBytes > 0 {
+			fmt.Printf(" (%s)", formatBytes(stats.ExtraBytes))
+		}
+	}
+
+	if stats.Collisions > 0 {
+		fmt.Printf(", %d name collisions", stats.Collisions)
+	}
+
+	if stats.MetaSkipped > 0 {
+		fmt.Printf(", %d metadata items skipped", stats.MetaSkipped)
+	}
+	if stats.MetaMerged > 0 {
+		fmt.Printf(", %d AppleDouble files merged", stats.MetaMerged)
+	}
+
+	if len(stats.Inconsistent) > 0 {
+		fmt.Printf(", %d files changed during copy", len(stats.Inconsistent))
+	}
+
+	if stats.Retries > 0 {
+		fmt.Printf(", %d retries", stats.Retries)
+	}
+
+	if len(stats.Failures) > 0 {
+		fmt.Printf(", %d errors", len(stats.Failures))
+	}
+
+	if len(stats.Damaged) > 0 {
+		fmt.Printf(", %d damaged files", len(stats.Damaged))
+	}
+
+	if stats.FilesLinked > 0 {
+		fmt.Printf(", %d unchanged files linked to the previous snapshot", stats.FilesLinked)
+	}
+
+	if stats.DirsPruned > 0 {
+		fmt.Printf(", %d empty directories pruned", stats.DirsPruned)
+	}
+
+	if stats.ExtraCopiedBack > 0 {
+		fmt.Printf(", %d extras copied back to source", stats.ExtraCopiedBack)
+	}
+
+	if stats.Trashed > 0 {
+		fmt.Printf(", %d items moved to the trash", stats.Trashed)
+	}
+
+	if stats.BackedUp > 0 {
+		fmt.Printf(", %d items moved to backup directory", stats.BackedUp)
+	}
+
+	if stats.BytesVerified > 0 {
+		fmt.Printf(", %s verified", formatBytes(stats.BytesVerified))
+	}
+
+	fmt.Printf("\n")
+
+	if len(stats.Inconsistent) > 0 {
+		fmt.Printf("\nFiles that changed while being copied (the copies may be inconsistent):\n")
+		for _, path := range stats.Inconsistent {
+			fmt.Printf("  INCONSISTENT: %s\n", path)
+		}
+	}
+
+	if len(stats.Damaged) > 0 {
+		fmt.Printf("\nDamaged files (unreadable regions were zero-filled in the copy):\n")
+		for _, damaged := range stats.Damaged {
+			fmt.Printf("  DAMAGED: %s\n", damaged.Path)
+			for _, r := range damaged.Bad {
+				fmt.Printf("    bad block at offset %d, %d bytes\n", r.Offset, r.Length)
+			}
+		}
+	}
+
+	if len(stats.Failures) > 0 {
+		fmt.Printf("\nErrors (%d):\n", len(stats.Failures))
+		for _, failure := range stats.Failures {
+			fmt.Printf("  ERROR [%s] %s: %v\n", failure.Op, failure.Path, failure.Err)
+		}
+	}
+}
+
+// copyFile copies a single file from src to dst if needed
+func copyFile(src, dst string, srcInfo os.FileInfo, opts *CopyOptions, stats *CopyStats) (err error) {
+	// Check if we need to copy the file
+	needsCopy, err := withWatchdogResult(dst, opts, func(progress *ioProgress) (bool, error) {
+		progress.step("stat")
+		return needsUpdate(src, dst, srcInfo)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !needsCopy {
+		fmt.Printf("%s (skipped - up to date)\n", src)
+		stats.FilesSkipped++
+		if opts.Manifest != nil {
+			return opts.Manifest.recordExisting(dst)
+		}
+		return nil
+	}
+
+	// In a snapshot, a file unchanged since the previous snapshot shares its copy there
+	if previous := previousSnapshotCopy(src, dst, srcInfo, opts); previous != "" {
+		if err := linkFromSnapshot(previous, dst, opts); err != nil {
+			return err
+		}
+		fmt.Printf("%s (linked - unchanged)\n", src)
+		stats.FilesLinked++
+		if opts.Manifest != nil {
+			return opts.Manifest.recordExisting(dst)
+		}
+		return nil
+	}
+
+	// A resumed snapshot may hold a hard link into the previous snapshot at dst. Writing through
+	// it would change the previous snapshot too, so the link is removed and a new file written.
+	if opts.SnapshotDir != "" {
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return opFailed("remove", dst, fmt.Errorf("failed to replace '%s': %w", dst, err))
+		}
+	}
+
+	fmt.Printf("%s", src)
+	defer func() {
+		// Terminate the progress line; a full disk has already been reported
+		if errors.Is(err, errStalled) {
+			fmt.Printf(" (STALLED)\n")
+		} else if err != nil && !isDiskFull(err) {
+			fmt.Printf(" (FAILED)\n")
+		}
+	}()
+
+	// Create destination directory if it doesn't exist
+	dstDir := filepath.Dir(dst)
+	if err := makeDirs(dstDir, 0755, opts); err != nil {
+		return opFailed("mkdir", dstDir, fmt.Errorf("failed to create destination directory '%s': %w", dstDir, err))
+	}
+
+	// The journal keeps the copy that is about to be replaced. If copying fails, the partial
+	// copy is removed and the original put back.
+	if opts.Journal != nil {
+		op := "create"
+		if _, err := os.Lstat(dst); err == nil {
+			if err := opts.Journal.preserve(dst); err != nil {
+				return err
+			}
+			op = "replace"
+		}
+		defer func() {
+			if err == nil {
+				err = opts.Journal.record(op, dst)
+				return
+			}
+			os.Remove(dst)
+			if op == "replace" {
+				opts.Journal.unpreserve(dst)
+			}
+		}()
+	}
+
+	// Keep the copy that is about to be replaced
+	if opts.BackupDir != "" {
+		if _, err := os.Lstat(dst); err == nil {
+			if err := moveToBackup(dst, opts); err != nil {
+				return err
+			}
+			fmt.Printf(" (old copy moved to backup)")
+			stats.BackedUp++
+		}
+	}
+
+	// Copy, then check that the source did not change while it was being read.
+	// A file that is still being written is copied again after a short pause.
+	// With --verify the copy is then read back and copied again if it differs.
+	var copied copyResult
+	for changes, mismatches := 0, 0; ; {
+		err = withRetry(opts, stats, func() error {
+			var err error
+			copied, err = withWatchdogResult(src, opts, func(progress *ioProgress) (copyResult, error) {
+				var hasher hash.Hash
+				if opts.Verify || opts.Manifest != nil {
+					hasher = sha256.New()
+				}
+				var result copyResult
+				var err error
+				result.written, result.elapsed, result.bad, err = copyFileContents(src, dst, srcInfo, opts, hasher, progress)
+				if hasher != nil {
+					result.sum = hasher.Sum(nil)
+				}
+				return result, err
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		afterInfo, err := os.Stat(src)
+		if err != nil {
+			return opFailed("stat", src, fmt.Errorf("failed to get source info for '%s': %w", src, err))
+		}
+		if afterInfo.Size() == srcInfo.Size() && afterInfo.ModTime().Equal(srcInfo.ModTime()) && copied.written == srcInfo.Size() {
+			if !opts.Verify {
+				break
+			}
+			err = withRetry(opts, stats, func() error {
+				return withWatchdog(dst, opts, func(progress *ioProgress) error {
+					return verifyFile(dst, copied.sum, progress)
+				})
+			})
+			if err == nil {
+				stats.BytesVerified += copied.written
+				break
+			}
+			if !errors.Is(err, errVerifyMismatch) || mismatches >= verifyRecopies {
+				// Make sure the next run does not take the bad copy for up to date
+				m := sanitizeFATTime(time.Time{})
+				if chErr := os.Chtimes(dst, m, m); chErr != nil {
+					return fmt.Errorf("%w (and the bad copy could not be marked for recopying: %v)", err, chErr)
+				}
+				return err
+			}
+			mismatches++
+			fmt.Printf(" (VERIFY FAILED - recopying)")
+			continue
+		}
+
+		srcInfo = afterInfo
+		if changes >= opts.ChangeRetries {
+			// Stamp the copy with the oldest valid time so needsUpdate never treats it as up to date
+			fmt.Printf(" (INCONSISTENT - source changed during copy)\n")
+			m := sanitizeFATTime(time.Time{})
+			if err := os.Chtimes(dst, m, m); err != nil {
+				return opFailed("chtimes", dst, fmt.Errorf("failed to set file times for '%s': %w", dst, err))
+			}
+			stats.Inconsistent = append(stats.Inconsistent, src)
+			stats.BytesCopied += copied.written
+			return nil
+		}
+		changes++
+		fmt.Printf(" (changed during copy, retrying)")
+		time.Sleep(time.Second)
+	}
+
+	// Set file times to match source AFTER the writing handle is closed, using sanitized time.
+	// A salvaged copy with holes gets the oldest valid time instead, so the next run tries again.
+	m := sanitizeFATTime(srcInfo.ModTime())
+	if len(copied.bad) > 0 {
+		m = sanitizeFATTime(time.Time{})
+	}
+	err = withRetry(opts, stats, func() error {
+		return withWatchdog(src, opts, func(progress *ioProgress) error {
+			progress.step("chtimes")
+			return os.Chtimes(dst, m, m)
+		})
+	})
+	if err != nil {
+		return opFailed("chtimes", dst, fmt.Errorf("failed to set file times for '%s': %w", dst, err))
+	}
+
+	// Calculate and display speed
+	elapsedSeconds := copied.elapsed.Seconds()
+	if elapsedSeconds < 0.001 { // Minimum 1ms to avoid division by near-zero
+		elapsedSeconds = 0.001
+	}
+	speed := float64(copied.written) / elapsedSeconds
+	if len(copied.bad) > 0 {
+		var badBytes int64
+		for _, r := range copied.bad {
+			badBytes += r.Length
+		}
+		fmt.Printf(" (%d bytes, %s, DAMAGED - %d bytes unreadable, zero-filled)\n", copied.written, formatSpeed(speed), badBytes)
+		stats.Damaged = append(stats.Damaged, DamagedFile{Path: src, Bad: copied.bad})
+	} else {
+		fmt.Printf(" (%d bytes, %s)\n", copied.written, formatSpeed(speed))
+	}
+
+	// Update statistics
+	stats.FilesCopied++
+	stats.BytesCopied += copied.written
+	if opts.Manifest != nil {
+		return opts.Manifest.record(dst, copied.sum)
+	}
+	return nil
+}
+
+// copyResult is the outcome of copying the contents of a file: the bytes written, the time it
+// took, the unreadable regions in salvage mode and the SHA-256 of the data when it was hashed
+type copyResult struct {
+	written int64
+	elapsed time.Duration
+	bad     []BadRange
+	sum     []byte
+}
+
+// copyFileContents writes the contents of src to dst and closes it, returning the bytes written,
+// the time spent copying and, in salvage mode, the source regions that could not be read.
+// When hasher is not nil, every byte written is also fed to it. Timestamps are left for the caller to set.
+func copyFileContents(src, dst string, srcInfo os.FileInfo, opts *CopyOptions, hasher hash.Hash, progress *ioProgress) (int64, time.Duration, []BadRange, error) {
+	// Open source file
+	progress.step("open")
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return 0, 0, nil, opFailed("open", src, fmt.Errorf("failed to open source file '%s': %w", src, err))
+	}
+	defer srcFile.Close()
+
+	// Create destination file
+	progress.step("create")
+	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, srcInfo.Mode())
+	if err != nil {
+		return 0, 0, nil, opFailed("create", dst, fmt.Errorf("failed to create destination file '%s': %w", dst, err))
+	}
+	// We'll close explicitly before setting timestamps to avoid Windows resetting mtime on Close
+
+	// Copy file contents and measure time. The watchdog needs to see every read,
+	// which means giving up the kernel's copy offload while it is enabled.
+	progress.step("copy")
+	var reader io.Reader = srcFile
+	if progress != nil {
+		reader = &progressReader{r: srcFile, progress: progress}
+	}
+	var writer io.Writer = dstFile
+	if hasher != nil {
+		writer = io.MultiWriter(dstFile, hasher)
+	}
+	startTime := time.Now()
+	var bytesWritten int64
+	var badRanges []BadRange
+	if opts.Salvage {
+		bytesWritten, badRanges, err = salvageCopy(writer, srcFile, srcInfo.Size(), opts, progress)
+	} else {
+		bytesWritten, err = io.Copy(writer, reader)
+	}
+	elapsedTime := time.Since(startTime)
+	if err != nil {
+		dstFile.Close()
+		removePartialFile(dst, err)
+		return 0, 0, nil, opFailed("copy", src, fmt.Errorf("failed to copy file content from '%s' to '%s': %w", src, dst, err))
+	}
+
+	// Ensure data is flushed to disk and close the handle before setting timestamps.
+	// Filesystems with delayed allocation may only report a full disk here.
+	progress.flush("sync", bytesWritten)
+	if err := dstFile.Sync(); err != nil {
+		dstFile.Close()
+		removePartialFile(dst, err)
+		return 0, 0, nil, opFailed("sync", dst, fmt.Errorf("failed to flush destination file '%s': %w", dst, err))
+	}
+	progress.flush("close", bytesWritten)
+	if err := dstFile.Close(); err != nil {
+		removePartialFile(dst, err)
+		return 0, 0, nil, opFailed("close", dst, fmt.Errorf("failed to close destination file '%s': %w", dst, err))
+	}
+
+	return bytesWritten, elapsedTime, badRanges, nil
+}
+
+// verifyFile reads dst back from the device and compares its SHA-256 hash with sum
+func verifyFile(dst string, sum []byte, progress *ioProgress) error {
+	progress.step("verify")
+	file, err := os.Open(dst)
+	if err != nil {
+		return opFailed("verify", dst, fmt.Errorf("failed to open '%s' for verification: %w", dst, err))
+	}
+	defer file.Close()
+
+	// The data was just written and is still cached; drop it so the read hits the device
+	if info, err := file.Stat(); err == nil {
+		progress.flush("verify", info.Size())
+	}
+	dropCache(file)
+	progress.step("verify")
+
+	var reader io.Reader = file
+	if progress != nil {
+		reader = &progressReader{r: file, progress: progress}
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return opFailed("verify", dst, fmt.Errorf("failed to read '%s' for verification: %w", dst, err))
+	}
+	if !bytes.Equal(hasher.Sum(nil), sum) {
+		return opFailed("verify", dst, fmt.Errorf("%w: '%s' does not match the source", errVerifyMismatch, dst))
+	}
+	return nil
+}
+
+// recordFailure handles the error from copying one entry. With --keep-going the failure is
+// recorded and nil is returned so copying continues; a full destination always stops the run.
+func recordFailure(path string, err error, opts *CopyOptions, stats *CopyStats) error {
+	if err == nil || !opts.KeepGoing || isDiskFull(err) {
+		return err
+	}
+
+	failure := CopyFailure{Path: path, Op: "copy", Err: err}
+	var opErr *opError
+	if errors.As(err, &opErr) {
+		failure.Path = opErr.path
+		failure.Op = opErr.op
+	}
+	stats.Failures = append(stats.Failures, failure)
+	fmt.Printf("ERROR: %v (continuing)\n", err)
+	return nil
+}
+
+// Read sizes used in salvage mode: large chunks while the media reads fine, and
+// sector-sized blocks to narrow down the unreadable parts of a chunk that failed
+const (
+	salvageChunkSize = 1 << 20
+	salvageBlockSize = 4096
+)
+
+// salvageCopy copies size bytes from src to dst in the spirit of ddrescue. A chunk that fails
+// to read is re-read block by block; blocks that still fail after opts.Retries retries are
+// zero-filled in the destination and returned as bad ranges. Write errors are returned as usual.
+func salvageCopy(dst io.Writer, src io.ReaderAt, size int64, opts *CopyOptions, progress *ioProgress) (int64, []BadRange, error) {
+	var written int64
+	var bad []BadRange
+	buf := make([]byte, salvageChunkSize)
+
+	write := func(b []byte) error {
+		n, err := dst.Write(b)
+		written += int64(n)
+		return err
+	}
+
+	for offset := int64(0); offset < size; {
+		chunk := int64(salvageChunkSize)
+		if size-offset < chunk {
+			chunk = size - offset
+		}
+
+		n, err := src.ReadAt(buf[:chunk], offset)
+		if n > 0 && progress != nil {
+			progress.last.Store(time.Now().UnixNano())
+		}
+		if err == nil || (err == io.EOF && int64(n) == chunk) {
+			if err := write(buf[:chunk]); err != nil {
+				return written, bad, err
+			}
+			offset += chunk
+			continue
+		}
+		if err == io.EOF {
+			// The source became shorter while it was being copied
+			return written, bad, write(buf[:n])
+		}
+
+		// Narrow the failure down block by block
+		for block := offset; block < offset+chunk; block += salvageBlockSize {
+			length := int64(salvageBlockSize)
+			if offset+chunk-block < length {
+				length = offset + chunk - block
+			}
+			data := buf[:length]
+
+			readable := false
+			for attempt := 0; attempt <= opts.Retries; attempt++ {
+				n, err := src.ReadAt(data, block)
+				if err == nil || (err == io.EOF && int64(n) == length) {
+					readable = true
+					break
+				}
+			}
+			if progress != nil {
+				progress.last.Store(time.Now().UnixNano())
+			}
+			if !readable {
+				clear(data)
+				if last := len(bad) - 1; last >= 0 && bad[last].Offset+bad[last].Length == block {
+					bad[last].Length += length
+				} else {
+					bad = append(bad, BadRange{Offset: block, Length: length})
+				}
+			}
+			if err := write(data); err != nil {
+				return written, bad, err
+			}
+		}
+		offset += chunk
+	}
+
+	return written, bad, nil
+}
+
+// ioProgress tells the stall watchdog which operation is running and when data last moved.
+// A nil *ioProgress is valid and ignores all updates, for when the watchdog is disabled.
+type ioProgress struct {
+	op    atomic.Value // string
+	last  atomic.Int64 // UnixNano of the last progress
+	grace atomic.Int64 // Time the current operation may take on top of the stall timeout
+}
+
+// flushRate is the slowest rate at which a device is assumed to write back cached data. A flush
+// counts as progress for as long as writing its data at this rate would take.
+const flushRate = 1 << 20
+
+// step records the start of a new operation, which counts as progress
+func (p *ioProgress) step(op string) {
+	if p == nil {
+		return
+	}
+	p.op.Store(op)
+	p.grace.Store(0)
+	p.last.Store(time.Now().UnixNano())
+}
+
+// flush records the start of an operation that writes size bytes back to the device in one
+// call, so no progress can be seen while it runs. It is given the time a slow device needs.
+func (p *ioProgress) flush(op string, size int64) {
+	if p == nil {
+		return
+	}
+	p.step(op)
+	p.grace.Store(int64(time.Duration(size) * time.Second / flushRate))
+}
+
+// progressReader reports every successful read to the watchdog
+type progressReader struct {
+	r        io.Reader
+	progress *ioProgress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	if n > 0 {
+		pr.progress.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// withWatchdog runs fn and fails with errStalled when it makes no progress for opts.StallTimeout.
+// A blocked system call cannot be interrupted, so a stalled fn is abandoned and left running
+// in the background while the caller moves on to the next file or ends the run.
+func withWatchdog(path string, opts *CopyOptions, fn func(progress *ioProgress) error) error {
+	_, err := withWatchdogResult(path, opts, func(progress *ioProgress) (struct{}, error) {
+		return struct{}{}, fn(progress)
+	})
+	return err
+}
+
+// watchdogResult carries the outcome of a watched operation back to withWatchdogResult
+type watchdogResult[T any] struct {
+	value T
+	err   error
+}
+
+// withWatchdogResult is withWatchdog for an fn that returns a value. The value is passed back
+// over a channel, so an abandoned fn never touches the caller's variables.
+func withWatchdogResult[T any](path string, opts *CopyOptions, fn func(progress *ioProgress) (T, error)) (T, error) {
+	if opts.StallTimeout <= 0 {
+		return fn(nil)
+	}
+
+	progress := &ioProgress{}
+	progress.step("start")
+	done := make(chan watchdogResult[T], 1)
+	go func() {
+		value, err := fn(progress)
+		done <- watchdogResult[T]{value, err}
+	}()
+
+	interval := opts.StallTimeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case result := <-done:
+			return result.value, result.err
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, progress.last.Load()))
+			if idle >= opts.StallTimeout+time.Duration(progress.grace.Load()) {
+				op := progress.op.Load().(string)
+				var zero T
+				return zero, opFailed(op, path, fmt.Errorf("%w: no progress for %v during %s of '%s'", errStalled, idle.Round(100*time.Millisecond), op, path))
+			}
+		}
+	}
+}
+
+// isTransient reports whether err is an I/O error that may succeed when repeated, as seen
+// on flaky USB connections and network shares
+func isTransient(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EIO, syscall.EAGAIN, syscall.ETIMEDOUT, syscall.EINTR, syscall.ECONNRESET} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	// ERROR_UNEXP_NET_ERR, ERROR_NETNAME_DELETED and ERROR_SEM_TIMEOUT
+	var errno syscall.Errno
+	return runtime.GOOS == "windows" && errors.As(err, &errno) && (errno == 59 || errno == 64 || errno == 121)
+}
+
+// withRetry runs fn and repeats it with exponential backoff while it fails with a transient
+// error, up to opts.Retries times. Retries are logged on the current progress line.
+func withRetry(opts *CopyOptions, stats *CopyStats, fn func() error) error {
+	delay := opts.RetryDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > opts.Retries || !isTransient(err) {
+			return err
+		}
+		fmt.Printf(" (retry %d/%d in %v: %v)", attempt, opts.Retries, delay, err)
+		stats.Retries++
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// expandDatePlaceholders replaces %Y, %m, %d, %H, %M and %S in pattern with the parts of t
+// (year, month, day, hour, minute, second) and %% with a single percent sign
+func expandDatePlaceholders(pattern string, t time.Time) string {
+	return strings.NewReplacer(
+		"%%", "%",
+		"%Y", t.Format("2006"),
+		"%m", t.Format("01"),
+		"%d", t.Format("02"),
+		"%H", t.Format("15"),
+		"%M", t.Format("04"),
+		"%S", t.Format("05"),
+	).Replace(pattern)
+}
+
+// backupRoot returns the directory that holds the backup directories of every run: the part
+// of pattern before its first placeholder, cut back to a whole path component ("." when the
+// first component already has a placeholder)
+func backupRoot(pattern string) string {
+	i := strings.Index(pattern, "%")
+	if i < 0 {
+		return filepath.Clean(pattern)
+	}
+	return filepath.Dir(pattern[:i])
+}
+
+// moveToBackup moves a destination file or directory into the backup directory, at the same
+// path relative to the destination root. The backup directory must be on the same filesystem.
+func moveToBackup(path string, opts *CopyOptions) error {
+	rel, err := filepath.Rel(opts.DestRoot, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("'%s' is not inside the destination '%s'", path, opts.DestRoot)
+	}
+	target := filepath.Join(opts.BackupDir, rel)
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return opFailed("mkdir", target, fmt.Errorf("failed to create backup directory '%s': %w", filepath.Dir(target), err))
+	}
+	if err := os.Rename(path, target); err != nil {
+		if errors.Is(err, syscall.EXDEV) {
+			return opFailed("backup", path, fmt.Errorf("backup directory '%s' must be on the same filesystem as '%s'", opts.BackupDir, path))
+		}
+		return opFailed("backup", path, fmt.Errorf("failed to move '%s' to backup directory: %w", path, err))
+	}
+	return nil
+}
+
+// sameFile reports whether two paths refer to the same existing file or directory
+func sameFile(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	return err == nil && os.SameFile(aInfo, bInfo)
+}
+
+// journalDirName is the directory in the destination root that holds the run journals (--journal)
+const journalDirName = ".smartcopy"
+
+// Journal records the changes a run makes to the destination, one line per change, and keeps
+// the originals of replaced and deleted files, so that `smartcopy undo` can revert the run.
+// Each line holds the operation, the size and modification time the path had after the
+// change, and the quoted path relative to the destination root:
+//
+//	mkdir   a directory was created
+//	create  a file was created
+//	replace a file was replaced; the original is kept in originals/
+//	delete  a file or directory was deleted; it is kept in originals/
+type Journal struct {
+	Root string // Destination root
+	Dir  string // Directory of this run, holding the journal and the originals
+	file *os.File
+}
+
+// startJournal creates the journal of a new run in the destination root
+func startJournal(root string, start time.Time) (*Journal, error) {
+	runs := filepath.Join(root, journalDirName, "runs")
+	if err := os.MkdirAll(runs, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory '%s': %w", runs, err)
+	}
+	name := start.Format(journalRunLayout)
+	dir := filepath.Join(runs, name)
+	for n := 2; ; n++ {
+		err := os.Mkdir(dir, 0755)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create journal directory '%s': %w", dir, err)
+		}
+		dir = filepath.Join(runs, fmt.Sprintf("%s-%d", name, n))
+	}
+
+	file, err := os.Create(filepath.Join(dir, "journal"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create journal in '%s': %w", dir, err)
+	}
+	return &Journal{Root: root, Dir: dir, file: file}, nil
+}
+
+// journalRunLayout is the time format of journal run directory names. Runs started in the same
+// second are numbered: NAME-2, NAME-3 and so on.
+const journalRunLayout = "20060102-150405"
+
+// journalRunLess orders journal run names by start time, and runs started in the same second
+// by number. Names that are not runs sort first.
+func journalRunLess(a, b string) bool {
+	ta, na, okA := parseJournalRun(a)
+	tb, nb, okB := parseJournalRun(b)
+	if okA != okB {
+		return okB
+	}
+	if !ta.Equal(tb) {
+		return ta.Before(tb)
+	}
+	return na < nb
+}
+
+// parseJournalRun returns the start time and number of a journal run from its directory name
+func parseJournalRun(name string) (time.Time, int, bool) {
+	if len(name) < len(journalRunLayout) {
+		return time.Time{}, 0, false
+	}
+	n := 1
+	if rest := name[len(journalRunLayout):]; rest != "" {
+		var err error
+		if n, err = strconv.Atoi(strings.TrimPrefix(rest, "-")); err != nil || n < 2 || !strings.HasPrefix(rest, "-") {
+			return time.Time{}, 0, false
+		}
+	}
+	t, err := time.ParseInLocation(journalRunLayout, name[:len(journalRunLayout)], time.Local)
+	return t, n, err == nil
+}
+
+// relPath returns the path of dst relative to the destination root
+func (j *Journal) relPath(path string) (string, error) {
+	rel, err := filepath.Rel(j.Root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' is not inside the destination '%s'", path, j.Root)
+	}
+	return rel, nil
+}
+
+// record appends a change to the journal, with the state the path has now
+func (j *Journal) record(op, path string) error {
+	rel, err := j.relPath(path)
+	if err != nil {
+		return err
+	}
+	var size, mtime int64
+	if op != "delete" {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return opFailed("stat", path, fmt.Errorf("failed to get info for '%s': %w", path, err))
+		}
+		if !info.IsDir() {
+			size, mtime = info.Size(), info.ModTime().UnixNano()
+		}
+	}
+	if _, err := fmt.Fprintf(j.file, "%s %d %d %s\n", op, size, mtime, strconv.Quote(filepath.ToSlash(rel))); err != nil {
+		return opFailed("journal", path, fmt.Errorf("failed to write journal '%s': %w", j.file.Name(), err))
+	}
+	return nil
+}
+
+// preserve moves path into the originals of this run before it is replaced or deleted
+func (j *Journal) preserve(path string) error {
+	rel, err := j.relPath(path)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(j.Dir, "originals", rel)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return opFailed("mkdir", target, fmt.Errorf("failed to create journal directory '%s': %w", filepath.Dir(target), err))
+	}
+	if err := os.Rename(path, target); err != nil {
+		return opFailed("journal", path, fmt.Errorf("failed to keep the original of '%s' in the journal: %w", path, err))
+	}
+	return nil
+}
+
+// unpreserve moves a preserved original back, after the change it was kept for failed
+func (j *Journal) unpreserve(path string) {
+	if rel, err := j.relPath(path); err == nil {
+		os.Rename(filepath.Join(j.Dir, "originals", rel), path)
+	}
+}
+
+func (j *Journal) close() error {
+	return j.file.Close()
+}
+
+// makeDirs creates dir and any missing parents like os.MkdirAll, recording each created
+// directory in the journal
+func makeDirs(dir string, perm os.FileMode, opts *CopyOptions) error {
+	if opts.Journal == nil {
+		return os.MkdirAll(dir, perm)
+	}
+
+	var missing []string
+	for p := dir; ; p = filepath.Dir(p) {
+		if _, err := os.Lstat(p); err == nil || filepath.Dir(p) == p {
+			break
+		}
+		missing = append(missing, p)
+	}
+	if err := os.MkdirAll(dir, perm); err != nil {
+		return err
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := opts.Journal.record("mkdir", missing[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// JournalEntry is one change read back from a journal
+type JournalEntry struct {
+	Op      string
+	Size    int64
+	ModTime int64 // UnixNano
+	Path    string
+}
+
+// runUndo implements the undo command: it reverts the most recent journaled run on a destination,
+// after checking that nothing it changed has been modified since
+func runUndo(args []string) error {
+	flags := flag.NewFlagSet("undo", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s undo <destination>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nReverts the most recent run that was made with --journal on the destination.\n")
+		fmt.Fprintf(os.Stderr, "Run it again to revert the run before that.\n")
+	}
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected exactly one destination")
+	}
+	root := args[0]
+
+	runs, err := os.ReadDir(filepath.Join(root, journalDirName, "runs"))
+	if err != nil || len(runs) == 0 {
+		return fmt.Errorf("no journaled runs found in '%s' (copy with --journal to make runs undoable)", root)
+	}
+	// Run directories are named by their start time, numbered within the same second
+	sort.Slice(runs, func(i, j int) bool { return journalRunLess(runs[i].Name(), runs[j].Name()) })
+	dir := filepath.Join(root, journalDirName, "runs", runs[len(runs)-1].Name())
+	entries, err := readJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Undoing run %s (%d changes)\n", filepath.Base(dir), len(entries))
+
+	if conflicts := checkJournal(root, dir, entries); len(conflicts) > 0 {
+		fmt.Printf("\nThe destination was modified after this run:\n")
+		for _, conflict := range conflicts {
+			fmt.Printf("  MODIFIED: %s\n", conflict)
+		}
+		return fmt.Errorf("refusing to undo: %d paths changed since the run", len(conflicts))
+	}
+
+	// Replay the journal backwards, so directories are removed after their contents
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		path := filepath.Join(root, filepath.FromSlash(entry.Path))
+		original := filepath.Join(dir, "originals", filepath.FromSlash(entry.Path))
+		switch entry.Op {
+		case "mkdir", "create":
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("failed to remove '%s': %w", path, err)
+			}
+			fmt.Printf("REMOVED: %s\n", path)
+		case "replace", "delete":
+			if entry.Op == "replace" {
+				if err := os.Remove(path); err != nil {
+					return fmt.Errorf("failed to remove '%s': %w", path, err)
+				}
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return fmt.Errorf("failed to create directory '%s': %w", filepath.Dir(path), err)
+			}
+			if err := os.Rename(original, path); err != nil {
+				return fmt.Errorf("failed to restore '%s': %w", path, err)
+			}
+			fmt.Printf("RESTORED: %s\n", path)
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove journal '%s': %w", dir, err)
+	}
+	fmt.Printf("\nSummary: %d changes reverted\n", len(entries))
+	return nil
+}
+
+// readJournal parses a journal file
+func readJournal(path string) ([]JournalEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal '%s': %w", path, err)
+	}
+	var entries []JournalEntry
+	for i, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		// The quoted path may contain spaces, so it is everything after the third field
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("malformed journal line %d in '%s'", i+1, path)
+		}
+		entry := JournalEntry{Op: fields[0]}
+		var sizeErr, timeErr error
+		entry.Size, sizeErr = strconv.ParseInt(fields[1], 10, 64)
+		entry.ModTime, timeErr = strconv.ParseInt(fields[2], 10, 64)
+		entry.Path, err = strconv.Unquote(fields[3])
+		if sizeErr != nil || timeErr != nil || err != nil {
+			return nil, fmt.Errorf("malformed journal line %d in '%s'", i+1, path)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// checkJournal returns the paths that no longer have the state the journal left them in
+func checkJournal(root, dir string, entries []JournalEntry) []string {
+	var conflicts []string
+	created := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Op == "mkdir" || entry.Op == "create" {
+			created[entry.Path] = true
+		}
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(root, filepath.FromSlash(entry.Path))
+		info, err := os.Lstat(path)
+		switch entry.Op {
+		case "mkdir":
+			if err != nil || !info.IsDir() {
+				conflicts = append(conflicts, path)
+				continue
+			}
+			// The directory must not hold anything the run did not put there
+			children, _ := os.ReadDir(path)
+			for _, child := range children {
+				if !created[entry.Path+"/"+child.Name()] {
+					conflicts = append(conflicts, filepath.Join(path, child.Name()))
+				}
+			}
+		case "create", "replace":
+			if err != nil || info.Size() != entry.Size || info.ModTime().UnixNano() != entry.ModTime {
+				conflicts = append(conflicts, path)
+			}
+		case "delete":
+			if err == nil {
+				conflicts = append(conflicts, path)
+			}
+		}
+		if entry.Op == "replace" || entry.Op == "delete" {
+			if _, err := os.Lstat(filepath.Join(dir, "originals", filepath.FromSlash(entry.Path))); err != nil {
+				conflicts = append(conflicts, path+" (original missing from the journal)")
+			}
 		}
 	}
+	return conflicts
+}
 
-	// Delete if requested
-	if syncOptions.DeleteExtra {
-		if len(extraFiles) > 0 || len(extraDirs) > 0 {
-			fmt.Printf("\nDeleting extra files/directories...\n")
-		}
+// isDiskFull reports whether err means the destination has no space (or quota) left
+func isDiskFull(err error) bool {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return true
+	}
+	// ERROR_HANDLE_DISK_FULL and ERROR_DISK_FULL
+	var errno syscall.Errno
+	return runtime.GOOS == "windows" && errors.As(err, &errno) && (errno == 39 || errno == 112)
+}
 
-		// Delete files first
-		for _, file := range extraFiles {
-			if err := os.Remove(file); err != nil {
-				fmt.Printf("  WARNING: Failed to delete file '%s': %v\n", file, err)
-			} else {
-				fmt.Printf("  DELETED: %s\n", file)
-				stats.ExtraDeleted++
+// removePartialFile deletes a destination file left incomplete because the disk filled up,
+// so that a truncated copy is never mistaken for a good one
+func removePartialFile(dst string, err error) {
+	if !isDiskFull(err) {
+		return
+	}
+	fmt.Printf(" (FAILED - destination full)\n")
+	if rmErr := os.Remove(dst); rmErr != nil {
+		fmt.Printf("WARNING: Failed to remove partial file '%s': %v\n", dst, rmErr)
+	} else {
+		fmt.Printf("REMOVED partial file: %s\n", dst)
+	}
+}
+
+// snapshotLayout is the time format of snapshot directory names, which sort by time
+const snapshotLayout = "2006-01-02_150405"
+
+// partialSuffix marks a snapshot directory whose run has not completed
+const partialSuffix = ".partial"
+
+// deletingSuffix marks a snapshot directory that is being removed by a prune
+const deletingSuffix = ".deleting"
+
+// latestName is the symlink in the snapshot root that points to the newest complete snapshot
+const latestName = "latest"
+
+// Snapshot is a run of --snapshot: a new directory in the destination that holds a full copy of
+// the sources, with files unchanged since the previous snapshot hard-linked instead of copied
+type Snapshot struct {
+	Root     string // Destination that holds the snapshots
+	Name     string // Directory name of this snapshot, from the time the run started
+	Dir      string // Directory being written; renamed to Name when the run completes
+	Previous string // Newest complete snapshot ("" for the first one)
+	Resumed  bool   // Dir was left by an interrupted run and may hold items since removed from the sources
+}
+
+// startSnapshot creates the directory of a new snapshot in root. An incomplete snapshot left by
+// an interrupted run is taken over, so what it already holds does not need to be copied again.
+func startSnapshot(root string, start time.Time) (*Snapshot, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory '%s': %w", root, err)
+	}
+	names, err := listSnapshots(root)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{Root: root, Name: start.Format(snapshotLayout)}
+	for n := 2; snapshotExists(root, snap.Name); n++ {
+		snap.Name = fmt.Sprintf("%s-%d", start.Format(snapshotLayout), n)
+	}
+	snap.Dir = filepath.Join(root, snap.Name+partialSuffix)
+
+	// The previous snapshot is the one latest points to, or else the newest one
+	if target, err := os.Readlink(filepath.Join(root, latestName)); err == nil && snapshotExists(root, filepath.Base(target)) {
+		snap.Previous = filepath.Join(root, filepath.Base(target))
+	} else if len(names) > 0 {
+		snap.Previous = filepath.Join(root, names[len(names)-1])
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot directory '%s': %w", root, err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasSuffix(entry.Name(), partialSuffix) && isSnapshotName(strings.TrimSuffix(entry.Name(), partialSuffix)) {
+			fmt.Printf("Resuming incomplete snapshot %s\n", entry.Name())
+			if err := os.Rename(filepath.Join(root, entry.Name()), snap.Dir); err != nil {
+				return nil, fmt.Errorf("failed to resume snapshot '%s': %w", entry.Name(), err)
 			}
+			snap.Resumed = true
+			return snap, nil
 		}
+	}
+	if err := os.Mkdir(snap.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory '%s': %w", snap.Dir, err)
+	}
+	return snap, nil
+}
 
-		// Delete directories (they should be empty after deleting files)
-		for _, dir := range extraDirs {
-			if err := os.RemoveAll(dir); err != nil {
-				fmt.Printf("  WARNING: Failed to delete directory '%s': %v\n", dir, err)
-			} else {
-				fmt.Printf("  DELETED: %s\n", dir)
-				stats.ExtraDeleted++
+// removeStale deletes what a resumed snapshot still holds from the interrupted run but is no
+// longer in the sources, so the finished snapshot shows the sources as they are now
+func (s *Snapshot) removeStale(sources []string, intoDest bool, opts *CopyOptions, stats *CopyStats) {
+	if !s.Resumed {
+		return
+	}
+
+	// Sources copied into the snapshot by name leave nothing else at its top level
+	targets := make(map[string]bool)
+	for _, source := range sources {
+		targets[targetPathFor(source, s.Dir, intoDest, opts)] = true
+	}
+	if !targets[s.Dir] {
+		entries, _ := os.ReadDir(s.Dir)
+		for _, entry := range entries {
+			path := filepath.Join(s.Dir, entry.Name())
+			if !targets[path] && entry.Name() != manifestName && entry.Name() != manifestLogName {
+				removeExtra(path, opts, stats)
 			}
 		}
 	}
 
+	for _, source := range sources {
+		extras, err := findExtraFiles(source, targetPathFor(source, s.Dir, intoDest, opts), opts)
+		if err != nil {
+			fmt.Printf("  WARNING: Failed to check '%s' for removed items: %v\n", s.Dir, err)
+			continue
+		}
+		for _, path := range append(extras.Files, extras.Dirs...) {
+			removeExtra(path, opts, stats)
+		}
+	}
+}
+
+// finish gives the snapshot its final name and points latest to it. The symlink is replaced
+// atomically, so it always points to a complete snapshot.
+func (s *Snapshot) finish() error {
+	final := filepath.Join(s.Root, s.Name)
+	if err := os.Rename(s.Dir, final); err != nil {
+		return fmt.Errorf("failed to complete snapshot '%s': %w", final, err)
+	}
+	s.Dir = final
+
+	link := filepath.Join(s.Root, latestName)
+	tmp := link + partialSuffix
+	os.Remove(tmp)
+	if err := os.Symlink(s.Name, tmp); err != nil {
+		fmt.Printf("WARNING: Failed to update '%s': %v\n", link, err)
+		return nil
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		fmt.Printf("WARNING: Failed to update '%s': %v\n", link, err)
+	}
 	return nil
 }
 
-// showSummary displays the final statistics
-func showSummary(stats *CopyStats, syncOptions *SyncOptions) {
-	totalTime := time.Since(stats.StartTime)
-	overallSpeed := float64(stats.BytesCopied) / totalTime.Seconds()
+// listSnapshots returns the names of the complete snapshots in root, oldest first
+func listSnapshots(root string) ([]string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot directory '%s': %w", root, err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && isSnapshotName(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return snapshotLess(names[i], names[j]) })
+	return names, nil
+}
 
-	fmt.Printf("\nSummary: %d files copied, %d files skipped, %s copied in %v (%s)",
-		stats.FilesCopied,
-		stats.FilesSkipped,
-		formatBytes(stats.BytesCopied),
-		totalTime.Round(time.Millisecond),
-		formatSpeed(overallSpeed))
+// isSnapshotName reports whether name is a snapshot time, possibly followed by -N
+func isSnapshotName(name string) bool {
+	_, ok := snapshotTime(name)
+	return ok
+}
 
-	// Add extra files information if sync options are enabled
-	if syncOptions.DetectExtra {
-		if syncOptions.DeleteExtra {
-			fmt.Printf(", %d extra items deleted", stats.ExtraDeleted)
-		} else {
-			fmt.Printf(", %d extra items found", stats.ExtraFound)
+// snapshotTime returns the time a snapshot was started, from its name
+func snapshotTime(name string) (time.Time, bool) {
+	if len(name) < len(snapshotLayout) {
+		return time.Time{}, false
+	}
+	if rest := name[len(snapshotLayout):]; rest != "" {
+		if n, err := strconv.Atoi(strings.TrimPrefix(rest, "-")); err != nil || n < 2 || !strings.HasPrefix(rest, "-") {
+			return time.Time{}, false
 		}
+	}
+	t, err := time.ParseInLocation(snapshotLayout, name[:len(snapshotLayout)], time.Local)
+	return t, err == nil
+}
 
-		if stats.ExtraBytes > 0 {
-			fmt.Printf(" (%s)", formatBytes(stats.ExtraBytes))
+// snapshotLess orders snapshot names by time, and runs started in the same second by number
+func snapshotLess(a, b string) bool {
+	ta, _ := snapshotTime(a)
+	tb, _ := snapshotTime(b)
+	if !ta.Equal(tb) {
+		return ta.Before(tb)
+	}
+	return len(a) < len(b) || (len(a) == len(b) && a < b)
+}
+
+// snapshotExists reports whether root holds a snapshot directory called name
+func snapshotExists(root, name string) bool {
+	info, err := os.Lstat(filepath.Join(root, name))
+	return err == nil && info.IsDir() && isSnapshotName(name)
+}
+
+// RetentionPolicy says which snapshots to keep: the newest Last ones, and the newest snapshot of
+// each of the Hourly most recent hours that have snapshots, of the Daily most recent days, and so on
+type RetentionPolicy struct {
+	Last    int
+	Hourly  int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+}
+
+// retentionFlags adds the --keep-* options to flags
+func retentionFlags(flags *flag.FlagSet) *RetentionPolicy {
+	p := &RetentionPolicy{}
+	flags.IntVar(&p.Last, "keep-last", 0, "when pruning snapshots, keep the newest N")
+	flags.IntVar(&p.Hourly, "keep-hourly", 0, "when pruning snapshots, keep the newest of each of the last N hours with snapshots")
+	flags.IntVar(&p.Daily, "keep-daily", 0, "when pruning snapshots, keep the newest of each of the last N days with snapshots")
+	flags.IntVar(&p.Weekly, "keep-weekly", 0, "when pruning snapshots, keep the newest of each of the last N weeks with snapshots")
+	flags.IntVar(&p.Monthly, "keep-monthly", 0, "when pruning snapshots, keep the newest of each of the last N months with snapshots")
+	flags.IntVar(&p.Yearly, "keep-yearly", 0, "when pruning snapshots, keep the newest of each of the last N years with snapshots")
+	return p
+}
+
+// empty reports whether no retention was asked for
+func (p *RetentionPolicy) empty() bool {
+	return *p == RetentionPolicy{}
+}
+
+// check rejects negative counts
+func (p *RetentionPolicy) check() error {
+	for _, n := range []int{p.Last, p.Hourly, p.Daily, p.Weekly, p.Monthly, p.Yearly} {
+		if n < 0 {
+			return fmt.Errorf("invalid --keep-* value %d (must be 0 or more)", n)
 		}
 	}
+	return nil
+}
+
+// keep applies the policy to the snapshot names (oldest first) and returns the snapshots to keep,
+// each with the rules that keep it. The newest snapshot is always kept.
+func (p *RetentionPolicy) keep(names []string) map[string][]string {
+	rules := []struct {
+		name  string
+		count int
+		key   func(name string, t time.Time) string
+	}{
+		{"last", p.Last, func(name string, _ time.Time) string { return name }},
+		{"hourly", p.Hourly, func(_ string, t time.Time) string { return t.Format("2006-01-02 15") }},
+		{"daily", p.Daily, func(_ string, t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.Weekly, func(_ string, t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", p.Monthly, func(_ string, t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", p.Yearly, func(_ string, t time.Time) string { return t.Format("2006") }},
+	}
 
-	fmt.Printf("\n")
+	kept := make(map[string][]string)
+	if len(names) > 0 {
+		kept[names[len(names)-1]] = nil
+	}
+	for _, rule := range rules {
+		last := ""
+		for i, n := len(names)-1, 0; i >= 0 && n < rule.count; i-- {
+			t, _ := snapshotTime(names[i])
+			if key := rule.key(names[i], t); key != last {
+				kept[names[i]] = append(kept[names[i]], rule.name)
+				last = key
+				n++
+			}
+		}
+	}
+	return kept
 }
 
-// copyFile copies a single file from src to dst if needed
-func copyFile(src, dst string, srcInfo os.FileInfo, stats *CopyStats) error {
-	// Check if we need to copy the file
-	needsCopy, err := needsUpdate(src, dst, srcInfo)
+// pruneSnapshots removes the snapshots in root that the policy does not keep, or only lists them
+// with dryRun. The snapshot latest points to is never removed.
+func pruneSnapshots(root string, policy RetentionPolicy, dryRun bool) error {
+	names, err := listSnapshots(root)
 	if err != nil {
 		return err
 	}
+	if len(names) == 0 {
+		fmt.Printf("No snapshots found in %s\n", root)
+		return nil
+	}
 
-	if !needsCopy {
-		fmt.Printf("%s (skipped - up to date)\n", src)
-		stats.FilesSkipped++
+	kept := policy.keep(names)
+	if target, err := os.Readlink(filepath.Join(root, latestName)); err == nil {
+		if name := filepath.Base(target); snapshotExists(root, name) {
+			kept[name] = append(kept[name], latestName)
+		}
+	}
+
+	var remove []string
+	for _, name := range names {
+		if rules, ok := kept[name]; ok {
+			if len(rules) == 0 {
+				rules = []string{"newest"}
+			}
+			fmt.Printf("  keep    %s (%s)\n", name, strings.Join(rules, ", "))
+		} else {
+			fmt.Printf("  remove  %s\n", name)
+			remove = append(remove, name)
+		}
+	}
+
+	freed, exact := reclaimableSpace(root, remove)
+	amount := formatBytes(freed)
+	if !exact {
+		amount = "up to " + amount
+	}
+	if dryRun {
+		fmt.Printf("\nWould remove %d of %d snapshots, freeing %s\n", len(remove), len(names), amount)
 		return nil
 	}
 
-	fmt.Printf("%s", src)
+	// A snapshot is renamed before it is removed, so one that is only partly removed is never
+	// taken for a complete snapshot. What an earlier prune failed to remove goes first.
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot directory '%s': %w", root, err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasSuffix(entry.Name(), deletingSuffix) && isSnapshotName(strings.TrimSuffix(entry.Name(), deletingSuffix)) {
+			if err := os.RemoveAll(filepath.Join(root, entry.Name())); err != nil {
+				fmt.Printf("WARNING: Failed to finish removing '%s': %v\n", entry.Name(), err)
+			}
+		}
+	}
+	removed, partly := 0, 0
+	for _, name := range remove {
+		deleting := filepath.Join(root, name+deletingSuffix)
+		if err := os.Rename(filepath.Join(root, name), deleting); err != nil {
+			fmt.Printf("WARNING: Failed to remove snapshot '%s': %v\n", name, err)
+			continue
+		}
+		removed++
+		if err := os.RemoveAll(deleting); err != nil {
+			fmt.Printf("WARNING: Snapshot '%s' was only partly removed, the rest is left in '%s': %v\n", name, deleting, err)
+			partly++
+		}
+	}
+	fmt.Printf("\nRemoved %d of %d snapshots, freeing %s\n", removed, len(names), amount)
+	if removed < len(remove) {
+		return fmt.Errorf("%d snapshots could not be removed", len(remove)-removed)
+	}
+	if partly > 0 {
+		return fmt.Errorf("%d snapshots were only partly removed; the next prune removes the rest", partly)
+	}
+	return nil
+}
 
-	// Create destination directory if it doesn't exist
-	dstDir := filepath.Dir(dst)
-	if err := os.MkdirAll(dstDir, 0755); err != nil {
-		return fmt.Errorf("failed to create destination directory '%s': %w", dstDir, err)
+// inode identifies the data of a file, shared by all its hard links
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// reclaimableSpace returns how many bytes removing the named snapshots in root frees. A file only
+// frees its space when all of its hard links are in the removed snapshots; files still linked
+// from a kept snapshot free nothing. Where hard links cannot be counted every file is included,
+// and the result is reported as not exact.
+func reclaimableSpace(root string, names []string) (int64, bool) {
+	var total int64
+	exact := true
+	seen := make(map[inode]uint64) // Links found in the removed snapshots
+	links := make(map[inode]uint64)
+	sizes := make(map[inode]int64)
+	for _, name := range names {
+		filepath.Walk(filepath.Join(root, name), func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			id, n, ok := fileID(info)
+			if !ok {
+				exact = false
+				total += info.Size()
+				return nil
+			}
+			seen[id]++
+			links[id] = n
+			sizes[id] = info.Size()
+			return nil
+		})
+	}
+	for id, n := range seen {
+		if n >= links[id] {
+			total += sizes[id]
+		}
 	}
+	return total, exact
+}
 
-	// Open source file
-	srcFile, err := os.Open(src)
+// runPrune implements the prune command: it applies a retention policy to the snapshots in a
+// destination written with --snapshot
+func runPrune(args []string) error {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	var dryRun = flags.Bool("dry-run", false, "only list which snapshots would be kept and removed")
+	policy := retentionFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s prune [--dry-run] --keep-...=N <destination>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nRemoves the snapshots made with --snapshot that the retention policy does not keep.\n")
+		fmt.Fprintf(os.Stderr, "A snapshot is kept when any of the --keep-* options keeps it. The newest snapshot\n")
+		fmt.Fprintf(os.Stderr, "and the one latest points to are always kept.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected exactly one destination")
+	}
+	if err := policy.check(); err != nil {
+		return err
+	}
+	if policy.empty() {
+		flags.Usage()
+		return fmt.Errorf("no retention policy given; use at least one --keep-* option")
+	}
+
+	root := args[0]
+	if *dryRun {
+		fmt.Printf("Previewing the retention policy for %s (nothing is removed)\n", root)
+	} else {
+		fmt.Printf("Applying the retention policy to %s\n", root)
+	}
+	return pruneSnapshots(root, *policy, *dryRun)
+}
+
+// snapshotRelPath returns the path of p inside a snapshot. p is either relative to a snapshot, or
+// a path into a snapshot in root (including latest), like /media/backup/latest/Documents.
+func snapshotRelPath(root, p string) (string, error) {
+	rel := filepath.Clean(p)
+	if absRoot, err := filepath.Abs(root); err == nil {
+		if absPath, err := filepath.Abs(p); err == nil {
+			if r, err := filepath.Rel(absRoot, absPath); err == nil && r != ".." && !strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+				first, rest, _ := strings.Cut(r, string(filepath.Separator))
+				if first == latestName || isSnapshotName(first) {
+					rel = rest
+				}
+			}
+		}
+	}
+	if rel == "" || rel == "." || filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' is not a path inside the snapshots in '%s'", p, root)
+	}
+	return rel, nil
+}
+
+// FileVersion is one distinct state of a file across snapshots
+type FileVersion struct {
+	Size      int64
+	ModTime   time.Time
+	Snapshots []string // Snapshots that hold this version, oldest first; the first one introduced it
+}
+
+// findVersions returns the distinct versions of the file rel across the snapshots in root,
+// oldest first. A file with a different size or modification time than in the snapshot before
+// is a new version, as is a file that reappears after it was missing.
+func findVersions(root, rel string) ([]*FileVersion, error) {
+	names, err := listSnapshots(root)
 	if err != nil {
-		return fmt.Errorf("failed to open source file '%s': %w", src, err)
+		return nil, err
 	}
-	defer srcFile.Close()
+	var versions []*FileVersion
+	var current *FileVersion
+	for _, name := range names {
+		info, err := os.Lstat(filepath.Join(root, name, rel))
+		if err != nil {
+			current = nil
+			continue
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("'%s' is a directory in snapshot %s; versions lists files", rel, name)
+		}
+		if current == nil || current.Size != info.Size() || !current.ModTime.Equal(info.ModTime()) {
+			current = &FileVersion{Size: info.Size(), ModTime: info.ModTime()}
+			versions = append(versions, current)
+		}
+		current.Snapshots = append(current.Snapshots, name)
+	}
+	return versions, nil
+}
 
-	// Create destination file
-	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, srcInfo.Mode())
+// runVersions implements the versions command: it lists the distinct versions of a file across
+// the snapshots in a destination written with --snapshot
+func runVersions(args []string) error {
+	flags := flag.NewFlagSet("versions", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s versions <destination> <path>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nLists the versions of a file in the snapshots made with --snapshot, with the snapshot\n")
+		fmt.Fprintf(os.Stderr, "that introduced each. The path is relative to a snapshot, or a path into one of them.\n")
+	}
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) != 2 {
+		flags.Usage()
+		return fmt.Errorf("expected a destination and a path")
+	}
+	root := args[0]
+	rel, err := snapshotRelPath(root, args[1])
 	if err != nil {
-		return fmt.Errorf("failed to create destination file '%s': %w", dst, err)
+		return err
 	}
-	// We'll close explicitly before setting timestamps to avoid Windows resetting mtime on Close
 
-	// Copy file contents and measure time
-	startTime := time.Now()
-	bytesWritten, err := io.Copy(dstFile, srcFile)
-	elapsedTime := time.Since(startTime)
+	versions, err := findVersions(root, rel)
 	if err != nil {
-		return fmt.Errorf("failed to copy file content from '%s' to '%s': %w", src, dst, err)
+		return err
 	}
+	if len(versions) == 0 {
+		return fmt.Errorf("'%s' is not in any snapshot in '%s'", rel, root)
+	}
+	fmt.Printf("Versions of %s in %s:\n", rel, root)
+	for _, v := range versions {
+		held := fmt.Sprintf("in %d snapshots, until %s", len(v.Snapshots), v.Snapshots[len(v.Snapshots)-1])
+		if len(v.Snapshots) == 1 {
+			held = "in 1 snapshot"
+		}
+		fmt.Printf("  %s  %8s  modified %s  (%s)\n", v.Snapshots[0], formatBytes(v.Size), v.ModTime.Format("2006-01-02 15:04:05"), held)
+	}
+	fmt.Printf("\n%d versions in %d snapshots\n", len(versions), countSnapshots(versions))
+	return nil
+}
 
-	// Ensure data is flushed to disk and close the handle before setting timestamps.
-	if err := dstFile.Sync(); err != nil {
-		return fmt.Errorf("failed to flush destination file '%s': %w", dst, err)
+// countSnapshots returns how many snapshots hold any of the versions
+func countSnapshots(versions []*FileVersion) int {
+	n := 0
+	for _, v := range versions {
+		n += len(v.Snapshots)
 	}
-	if err := dstFile.Close(); err != nil {
-		return fmt.Errorf("failed to close destination file '%s': %w", dst, err)
+	return n
+}
+
+// parsePointInTime parses the --at value of restore. A date without a time means the end of that day.
+func parsePointInTime(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05", snapshotLayout} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
 	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --at value '%s' (expected a date like 2006-01-02 or 2006-01-02 15:04)", value)
+}
 
-	// Set file times to match source AFTER the writing handle is closed, using sanitized time.
-	m := sanitizeFATTime(srcInfo.ModTime())
-	if err := os.Chtimes(dst, m, m); err != nil {
-		return fmt.Errorf("failed to set file times for '%s': %w", dst, err)
+// runRestore implements the restore command: it copies a file or directory from a snapshot back to
+// a target, with the same rules and preserved times as a copy
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	var snapshotName = flags.String("snapshot", "", "restore from this snapshot (default: the newest one that holds the path)")
+	var at = flags.String("at", "", "restore the state at this time, e.g. \"2026-10-17 09:00\": the newest snapshot taken before it")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s restore [--snapshot=NAME | --at=TIME] <destination> <path> <target>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nCopies a file or directory from a snapshot made with --snapshot to target. The path is\n")
+		fmt.Fprintf(os.Stderr, "relative to a snapshot, or a path into one of them. An existing target directory\n")
+		fmt.Fprintf(os.Stderr, "receives the restored item inside it, like a copy does.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) != 3 {
+		flags.Usage()
+		return fmt.Errorf("expected a destination, a path and a target")
+	}
+	if *snapshotName != "" && *at != "" {
+		return fmt.Errorf("--snapshot and --at cannot be used together")
+	}
+	root, target := args[0], args[2]
+	rel, err := snapshotRelPath(root, args[1])
+	if err != nil {
+		return err
 	}
 
-	// Calculate and display speed
-	elapsedSeconds := elapsedTime.Seconds()
-	if elapsedSeconds < 0.001 { // Minimum 1ms to avoid division by near-zero
-		elapsedSeconds = 0.001
+	// Pick the newest snapshot that holds the path, before the point in time if one is given
+	names, err := listSnapshots(root)
+	if err != nil {
+		return err
+	}
+	var limit time.Time
+	if *at != "" {
+		if limit, err = parsePointInTime(*at); err != nil {
+			return err
+		}
+	}
+	chosen := ""
+	for i := len(names) - 1; i >= 0 && chosen == ""; i-- {
+		name := names[i]
+		if *snapshotName != "" && name != *snapshotName {
+			continue
+		}
+		if t, _ := snapshotTime(name); *at != "" && t.After(limit) {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(root, name, rel)); err == nil {
+			chosen = name
+		}
+	}
+	if chosen == "" {
+		switch {
+		case *snapshotName != "":
+			return fmt.Errorf("'%s' is not in snapshot '%s' in '%s'", rel, *snapshotName, root)
+		case *at != "":
+			return fmt.Errorf("'%s' is not in any snapshot taken before %s", rel, limit.Format("2006-01-02 15:04:05"))
+		default:
+			return fmt.Errorf("'%s' is not in any snapshot in '%s'", rel, root)
+		}
 	}
-	speed := float64(bytesWritten) / elapsedSeconds
-	fmt.Printf(" (%d bytes, %s)\n", bytesWritten, formatSpeed(speed))
 
-	// Update statistics
-	stats.FilesCopied++
-	stats.BytesCopied += bytesWritten
+	source := filepath.Join(root, chosen, rel)
+	targetInfo, err := os.Stat(target)
+	intoDest := err == nil && targetInfo.IsDir()
+	opts := &CopyOptions{Normalize: "none", MacMetadata: "copy"}
+	if err := checkOverlap([]string{source}, target, intoDest, opts); err != nil {
+		return err
+	}
+	fmt.Printf("Restoring %s from snapshot %s\n", rel, chosen)
+
+	stats := &CopyStats{StartTime: time.Now()}
+	if err := copyRecursively(source, targetPathFor(source, target, intoDest, opts), opts, stats); err != nil {
+		return err
+	}
+	showSummary(stats, &SyncOptions{})
+	return nil
+}
+
+// previousSnapshotCopy returns the copy of src in the previous snapshot when it can be linked
+// instead of copying src to dst: it must be a regular file that needsUpdate finds up to date
+func previousSnapshotCopy(src, dst string, srcInfo os.FileInfo, opts *CopyOptions) string {
+	if opts.LinkDest == "" {
+		return ""
+	}
+	rel, err := filepath.Rel(opts.SnapshotDir, dst)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	previous := filepath.Join(opts.LinkDest, rel)
+	if info, err := os.Lstat(previous); err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	if needsCopy, err := needsUpdate(src, previous, srcInfo); err != nil || needsCopy {
+		return ""
+	}
+	return previous
+}
+
+// linkFromSnapshot hard-links dst to the copy of the file in the previous snapshot
+func linkFromSnapshot(previous, dst string, opts *CopyOptions) error {
+	dstDir := filepath.Dir(dst)
+	if err := makeDirs(dstDir, 0755, opts); err != nil {
+		return opFailed("mkdir", dstDir, fmt.Errorf("failed to create destination directory '%s': %w", dstDir, err))
+	}
+	// An outdated copy left by an interrupted run is replaced
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return opFailed("remove", dst, fmt.Errorf("failed to replace '%s': %w", dst, err))
+	}
+	if err := os.Link(previous, dst); err != nil {
+		return opFailed("link", dst, fmt.Errorf("failed to hard-link '%s' (snapshots need a filesystem with hard links): %w", dst, err))
+	}
 	return nil
 }
 
+// reportDiskFull stops the run after the destination filled up: it lists the files that were
+// not copied and how many bytes remain, then returns an error carrying ExitDiskFull
+func reportDiskFull(cause error, sources []string, destination string, intoDest bool, syncOptions *SyncOptions, opts *CopyOptions, stats *CopyStats) error {
+	plan := &SpacePlan{}
+	for _, source := range sources {
+		if err := planCopy(source, targetPathFor(source, destination, intoDest, opts), opts, plan); err != nil {
+			fmt.Printf("WARNING: Failed to determine remaining files: %v\n", err)
+			break
+		}
+	}
+
+	fmt.Printf("\nDestination is full - stopped copying.\n")
+	if plan.Files > 0 {
+		fmt.Printf("Not copied (%d files, %s remaining):\n", plan.Files, formatBytes(plan.Bytes))
+		for _, path := range plan.Pending {
+			fmt.Printf("  PENDING: %s\n", path)
+		}
+	}
+
+	showSummary(stats, syncOptions)
+	return &exitError{
+		code: ExitDiskFull,
+		err:  fmt.Errorf("destination '%s' is full, %s in %d files not copied: %w", destination, formatBytes(plan.Bytes), plan.Files, cause),
+	}
+}
+
 // needsUpdate checks if the destination file needs to be updated
 func needsUpdate(src, dst string, srcInfo os.FileInfo) (bool, error) {
 	dstInfo, err := os.Stat(dst)
@@ -466,7 +4431,7 @@ func needsUpdate(src, dst string, srcInfo os.FileInfo) (bool, error) {
 		return true, nil
 	}
 	if err != nil {
-		return false, fmt.Errorf("failed to get destination file info for '%s': %w", dst, err)
+		return false, opFailed("stat", dst, fmt.Errorf("failed to get destination file info for '%s': %w", dst, err))
 	}
 
 	// Compare size and modification time
@@ -474,21 +4439,18 @@ func needsUpdate(src, dst string, srcInfo os.FileInfo) (bool, error) {
 		return true, nil
 	}
 
-	// Compare modification times with 5-second tolerance for filesystems like exFAT
-	// which have 2-second resolution (we use 5 seconds for safety margin)
-	srcModTime := srcInfo.ModTime()
-	dstModTime := dstInfo.ModTime()
+	// Files are the same size; copy them unless they have similar modification times
+	return !sameModTime(srcInfo.ModTime(), dstInfo.ModTime()), nil
+}
 
+// sameModTime compares modification times with 5-second tolerance for filesystems like exFAT
+// which have 2-second resolution (we use 5 seconds for safety margin)
+func sameModTime(srcModTime, dstModTime time.Time) bool {
 	timeDiff := srcModTime.Sub(dstModTime)
 	if timeDiff < 0 {
 		timeDiff = -timeDiff
 	}
 
 	// If the time difference is more than 5 seconds, consider it different
-	if timeDiff > 5*time.Second {
-		return true, nil
-	}
-
-	// Files are the same size and have similar modification times
-	return false, nil
+	return timeDiff <= 5*time.Second
 }
@@ -0,0 +1,168 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// checkTrash makes sure that extras in dir can be moved to a trash, so that a run fails up
+// front instead of leaving every extra in place. A destination that does not exist yet will be
+// created on the filesystem of its nearest existing parent.
+func checkTrash(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(abs)
+	for err != nil && filepath.Dir(abs) != abs {
+		abs = filepath.Dir(abs)
+		info, err = os.Stat(abs)
+	}
+	if err != nil {
+		return err
+	}
+	// trashDirFor looks for the top directory from the parent of an item, so pass one inside dir
+	_, _, err = trashDirFor(filepath.Join(abs, "extra"), deviceOf(info))
+	return err
+}
+
+// moveToTrash moves path into the freedesktop.org trash of the filesystem that holds it:
+// the home trash when it is on the same filesystem, otherwise $topdir/.Trash/$uid or
+// $topdir/.Trash-$uid. A .trashinfo file records the original path and deletion date,
+// so the file manager can restore it.
+func moveToTrash(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(abs)
+	if err != nil {
+		return err
+	}
+	dev := deviceOf(info)
+
+	trash, topdir, err := trashDirFor(abs, dev)
+	if err != nil {
+		return err
+	}
+
+	// Paths in a trash on the same volume are stored relative to its top directory,
+	// so the trash keeps working when removable media is mounted elsewhere
+	original := abs
+	if topdir != "" {
+		if rel, err := filepath.Rel(topdir, abs); err == nil {
+			original = rel
+		}
+	}
+	contents := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+		(&url.URL{Path: original}).EscapedPath(), time.Now().Format("2006-01-02T15:04:05"))
+
+	// Reserve a unique name by creating its .trashinfo file first, as the specification requires
+	base := filepath.Base(abs)
+	for n := 1; ; n++ {
+		name := base
+		if n > 1 {
+			name = base + "." + strconv.Itoa(n)
+		}
+		infoPath := filepath.Join(trash, "info", name+".trashinfo")
+		file, err := os.OpenFile(infoPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create '%s': %w", infoPath, err)
+		}
+		_, err = file.WriteString(contents)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(abs, filepath.Join(trash, "files", name))
+		}
+		if err != nil {
+			os.Remove(infoPath)
+			return fmt.Errorf("failed to move '%s' to the trash '%s': %w", abs, trash, err)
+		}
+		return nil
+	}
+}
+
+// trashDirFor returns the trash directory to use for a file on device dev, and the top
+// directory of that device when the trash is not the home trash
+func trashDirFor(path string, dev uint64) (string, string, error) {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			dataHome = filepath.Join(home, ".local", "share")
+		}
+	}
+	if dataHome != "" {
+		home := filepath.Join(dataHome, "Trash")
+		if existing, err := nearestExisting(home); err == nil && deviceOf(existing) == dev {
+			if err := makeTrashDir(home); err == nil {
+				return home, "", nil
+			}
+		}
+	}
+
+	topdir := filepath.Dir(path)
+	for {
+		parent := filepath.Dir(topdir)
+		info, err := os.Stat(parent)
+		if parent == topdir || err != nil || deviceOf(info) != dev {
+			break
+		}
+		topdir = parent
+	}
+	uid := strconv.Itoa(os.Getuid())
+
+	// An administrator-created .Trash is only trusted when it is a real directory with the sticky bit
+	if info, err := os.Lstat(filepath.Join(topdir, ".Trash")); err == nil && info.IsDir() && info.Mode()&os.ModeSticky != 0 {
+		shared := filepath.Join(topdir, ".Trash", uid)
+		if err := makeTrashDir(shared); err == nil {
+			return shared, topdir, nil
+		}
+	}
+	private := filepath.Join(topdir, ".Trash-"+uid)
+	if err := makeTrashDir(private); err != nil {
+		return "", "", fmt.Errorf("no usable trash directory for '%s' (home trash is on another filesystem, cannot create '%s': %w)", path, private, err)
+	}
+	return private, topdir, nil
+}
+
+// makeTrashDir creates a trash directory with its files and info subdirectories
+func makeTrashDir(dir string) error {
+	for _, sub := range []string{"files", "info"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nearestExisting returns the file info of path or of its nearest existing ancestor
+func nearestExisting(path string) (os.FileInfo, error) {
+	for {
+		info, err := os.Stat(path)
+		if err == nil || filepath.Dir(path) == path {
+			return info, err
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// deviceOf returns the ID of the device that holds a file
+func deviceOf(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev)
+	}
+	return 0
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// errNoTrash is returned on platforms without trash support
+var errNoTrash = errors.New("the freedesktop.org trash is not supported on this platform")
+
+// checkTrash fails, as there is no trash to move extras to on this platform
+func checkTrash(dir string) error {
+	return errNoTrash
+}
+
+// moveToTrash is not implemented on this platform
+func moveToTrash(path string) error {
+	return errNoTrash
+}
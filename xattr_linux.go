@@ -0,0 +1,29 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// setXattr stores an extended attribute on path. Linux only allows arbitrary names in the
+// user namespace, so macOS attribute names are prefixed with "user.".
+func setXattr(path, name string, value []byte) error {
+	err := syscall.Setxattr(path, "user."+name, value, 0)
+	if errors.Is(err, syscall.ENOTSUP) {
+		return errXattrUnsupported
+	}
+	// Most file systems limit the size of attributes (ext4 to a block), which large resource
+	// forks exceed. Depending on the file system that is reported as E2BIG, ENOSPC or ERANGE.
+	if errors.Is(err, syscall.E2BIG) || errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.ERANGE) {
+		return fmt.Errorf("%w: attribute '%s' is too large (%v)", errXattrUnsupported, name, err)
+	}
+	return err
+}
+
+// removeXattr deletes an extended attribute set by setXattr
+func removeXattr(path, name string) error {
+	return syscall.Removexattr(path, "user."+name)
+}
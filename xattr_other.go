@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+// setXattr is not implemented on this platform, so AppleDouble files are copied as plain files
+func setXattr(path, name string, value []byte) error {
+	return errXattrUnsupported
+}
+
+// removeXattr has nothing to remove, since setXattr never sets an attribute here
+func removeXattr(path, name string) error {
+	return nil
+}